@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const authNonceSize = 32
+const authTimeout = 10 * time.Second
+
+type AuthPayload struct {
+	Nonce string `json:"nonce,omitempty"`
+	Mac   string `json:"mac,omitempty"`
+}
+
+func newAuthNonce() ([]byte, error) {
+	nonce := make([]byte, authNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+func authMac(role string, first, second []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(config.AuthKey))
+	mac.Write([]byte(role))
+	mac.Write(first)
+	mac.Write(second)
+	return mac.Sum(nil)
+}
+func authenticateServer(conn net.Conn, writer *json.Encoder, reader *json.Decoder) error {
+	conn.SetDeadline(time.Now().Add(authTimeout))
+	defer conn.SetDeadline(time.Time{})
+	var challenge AuthPayload
+	if err := readMessage(reader, msgAuthChallenge, &challenge); err != nil {
+		return err
+	}
+	serverNonce, err := hex.DecodeString(challenge.Nonce)
+	if err != nil || len(serverNonce) != authNonceSize {
+		return errors.New("malformed server nonce")
+	}
+	clientNonce, err := newAuthNonce()
+	if err != nil {
+		return err
+	}
+	response := AuthPayload{
+		Nonce: hex.EncodeToString(clientNonce),
+		Mac:   hex.EncodeToString(authMac("client", serverNonce, clientNonce)),
+	}
+	if err := writeMessage(writer, msgAuthResponse, response); err != nil {
+		return err
+	}
+	var reply Message
+	if err := reader.Decode(&reply); err != nil {
+		return err
+	}
+	if reply.Type == msgAuthFailed {
+		return errors.New("server rejected our authentication key")
+	}
+	if reply.Type != msgAuthOk {
+		return fmt.Errorf("expected '%s', got '%s'", msgAuthOk, reply.Type)
+	}
+	var result AuthPayload
+	if err := decodePayload(reply, &result); err != nil {
+		return err
+	}
+	serverMac, err := hex.DecodeString(result.Mac)
+	if err != nil || !hmac.Equal(serverMac, authMac("server", clientNonce, serverNonce)) {
+		return errors.New("server failed to prove knowledge of the authentication key")
+	}
+	return nil
+}
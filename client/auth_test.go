@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+)
+
+func testAuthMac(key, role string, first, second []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(role))
+	mac.Write(first)
+	mac.Write(second)
+	return mac.Sum(nil)
+}
+func TestAuthenticateServer(t *testing.T) {
+	tests := []struct {
+		name        string
+		serverKey   string
+		serverNonce string
+		reply       string
+		wantErr     string
+	}{
+		{"matching key", "secret", "", msgAuthOk, ""},
+		{"server proves wrong key", "guess", "", msgAuthOk, "failed to prove"},
+		{"server rejects client", "secret", "", msgAuthFailed, "rejected"},
+		{"error mentioning auth_failed", "secret", "", msgError, "expected 'auth_ok', got 'error'"},
+		{"malformed nonce", "secret", "abcd", msgAuthOk, "malformed"},
+	}
+	config.AuthKey = "secret"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+			defer serverConn.Close()
+			errc := make(chan error, 1)
+			go func() {
+				defer clientConn.Close()
+				errc <- authenticateServer(clientConn, json.NewEncoder(clientConn), json.NewDecoder(clientConn))
+			}()
+			writer := json.NewEncoder(serverConn)
+			reader := json.NewDecoder(serverConn)
+			serverNonce := make([]byte, authNonceSize)
+			challenge := AuthPayload{Nonce: hex.EncodeToString(serverNonce)}
+			if tt.serverNonce != "" {
+				challenge.Nonce = tt.serverNonce
+			}
+			if err := writeMessage(writer, msgAuthChallenge, challenge); err != nil {
+				t.Fatalf("writing challenge: %v", err)
+			}
+			if tt.serverNonce == "" {
+				var response AuthPayload
+				if err := readMessage(reader, msgAuthResponse, &response); err != nil {
+					t.Fatalf("reading response: %v", err)
+				}
+				clientNonce, _ := hex.DecodeString(response.Nonce)
+				if response.Mac != hex.EncodeToString(testAuthMac("secret", "client", serverNonce, clientNonce)) {
+					t.Fatal("client proof does not match the shared key")
+				}
+				switch tt.reply {
+				case msgAuthFailed:
+					writeMessage(writer, msgAuthFailed, nil)
+				case msgError:
+					writeMessage(writer, msgError, ErrorPayload{Code: errUnexpectedMessage, Message: "auth_failed earlier"})
+				default:
+					writeMessage(writer, msgAuthOk, AuthPayload{Mac: hex.EncodeToString(testAuthMac(tt.serverKey, "server", clientNonce, serverNonce))})
+				}
+			}
+			err := <-errc
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("authenticateServer() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("authenticateServer() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
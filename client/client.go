@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,6 +8,7 @@ import (
 	"net/url"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -25,15 +25,51 @@ type KcpConfig struct {
 	RcvWnd       int
 	DataShards   int
 	ParityShards int
+	Crypt        string
+	Key          string
+	Mode         string
+	Mtu          int
+	AckNoDelay   bool
+	StreamMode   bool
+	WriteDelay   bool
+	Dscp         int
+	ReadBuffer   int
+	WriteBuffer  int
 }
 type ClientConfig struct {
-	ControlServerAddress string
-	LocalListenPort      string
-	RemoteServerIP       string
-	KcpConfig            KcpConfig
+	ControlServerAddress  string
+	LocalListenPort       string
+	RemoteServerIP        string
+	KcpConfig             KcpConfig
+	MuxConfig             MuxConfig
+	MuxConnections        int
+	MuxBalance            string
+	ReverseMappings       []ReverseTarget
+	Mappings              []LocalMapping
+	FrontEnd              string
+	ProxyUsername         string
+	ProxyPassword         string
+	UdpOverMux            bool
+	UdpIdleTimeout        int
+	AuthKey               string
+	HeartbeatInterval     int
+	HeartbeatTimeout      int
+	TlsServerName         string
+	TlsCAPath             string
+	TlsPinSHA256          string
+	TlsInsecureSkipVerify bool
+	TlsClientCertPath     string
+	TlsClientKeyPath      string
+	KcpPinned             bool
+	ControlTransport      string
+	ControlPath           string
 }
 
+const muxDrainTimeout = 30 * time.Second
+
 var config ClientConfig
+var sessionToken string
+var sessionTokenMu sync.Mutex
 var bufferPool = sync.Pool{
 	New: func() interface{} {
 		b := make([]byte, 64*1024)
@@ -41,14 +77,6 @@ var bufferPool = sync.Pool{
 	},
 }
 
-type Message struct {
-	Command string `json:"command"`
-	Payload string `json:"payload"`
-}
-type TransportConfig struct {
-	Protocol string `json:"protocol"`
-	Port     string `json:"port"`
-}
 type wsConnWrapper struct {
 	*websocket.Conn
 	r io.Reader
@@ -69,6 +97,12 @@ func (c *wsConnWrapper) Read(b []byte) (int, error) {
 	}
 	return n, err
 }
+func (c *wsConnWrapper) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
 func (c *wsConnWrapper) Write(b []byte) (int, error) {
 	err := c.WriteMessage(websocket.BinaryMessage, b)
 	if err != nil {
@@ -96,45 +130,93 @@ func relayConnections(dst io.Writer, src io.Reader) {
 	defer bufferPool.Put(bufPtr)
 	io.CopyBuffer(dst, src, *bufPtr)
 }
-func startTcpDataForwarder(dataPort string) {
-	listener, _ := net.Listen("tcp", config.LocalListenPort)
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+type countingConn struct {
+	net.Conn
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&forwarderStats.BytesSent, int64(n))
+	return n, err
+}
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&forwarderStats.BytesReceived, int64(n))
+	return n, err
+}
+func serveLocalConnections(listener net.Listener, handle func(net.Conn)) {
 	defer listener.Close()
-	remoteDataAddr := config.RemoteServerIP + ":" + dataPort
 	for {
 		localConn, err := listener.Accept()
 		if err != nil {
-			continue
+			return
 		}
-		go func(lconn net.Conn) {
-			defer lconn.Close()
-			rconn, err := net.Dial("tcp", remoteDataAddr)
-			if err != nil {
-				return
-			}
-			defer rconn.Close()
-			go relayConnections(rconn, lconn)
-			relayConnections(lconn, rconn)
-		}(localConn)
+		atomic.AddInt64(&forwarderStats.ActiveConnections, 1)
+		atomic.AddInt64(&forwarderStats.TotalConnections, 1)
+		go func() {
+			defer atomic.AddInt64(&forwarderStats.ActiveConnections, -1)
+			handle(&countingConn{Conn: localConn})
+		}()
 	}
 }
-func startUdpDataForwarder(dataPort string) {
-	localAddr, _ := net.ResolveUDPAddr("udp", config.LocalListenPort)
-	localConn, _ := net.ListenUDP("udp", localAddr)
+func remoteDataAddress(dataPort string) string {
+	return config.RemoteServerIP + ":" + dataPort
+}
+func startTcpDataForwarder(f *forwarder) (io.Closer, error) {
+	remoteDataAddr := remoteDataAddress(f.Port)
+	return serveMappings(f, func(header StreamHeader) (io.ReadWriteCloser, error) {
+		rconn, err := net.Dial("tcp", remoteDataAddr)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeStreamHeader(rconn, header); err != nil {
+			rconn.Close()
+			return nil, err
+		}
+		return rconn, nil
+	})
+}
+func startUdpDataForwarder(f *forwarder) (io.Closer, error) {
+	localAddr, err := net.ResolveUDPAddr("udp", config.LocalListenPort)
+	if err != nil {
+		return nil, err
+	}
+	udpServerAddr, err := net.ResolveUDPAddr("udp", remoteDataAddress(f.Port))
+	if err != nil {
+		return nil, err
+	}
+	localConn, err := net.ListenUDP("udp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	go serveUdpForwarder(localConn, udpServerAddr)
+	return localConn, nil
+}
+func serveUdpForwarder(localConn *net.UDPConn, udpServerAddr *net.UDPAddr) {
 	defer localConn.Close()
-	remoteDataAddr := config.RemoteServerIP + ":" + dataPort
 	sessions := make(map[string]*net.UDPConn)
 	var mu sync.Mutex
 	buf := make([]byte, 4096)
 	for {
 		n, clientAddr, err := localConn.ReadFromUDP(buf)
 		if err != nil {
-			continue
+			return
 		}
 		mu.Lock()
 		remoteConn, ok := sessions[clientAddr.String()]
 		if !ok {
-			udpServerAddr, _ := net.ResolveUDPAddr("udp", remoteDataAddr)
-			remoteConn, _ = net.DialUDP("udp", nil, udpServerAddr)
+			remoteConn, err = net.DialUDP("udp", nil, udpServerAddr)
+			if err != nil {
+				mu.Unlock()
+				continue
+			}
 			sessions[clientAddr.String()] = remoteConn
 			go func(lconn *net.UDPConn, rconn *net.UDPConn, cAddr *net.UDPAddr) {
 				remoteBufPtr := bufferPool.Get().(*[]byte)
@@ -149,248 +231,342 @@ func startUdpDataForwarder(dataPort string) {
 						return
 					}
 					lconn.WriteToUDP((*remoteBufPtr)[:m], cAddr)
+					atomic.AddInt64(&forwarderStats.BytesReceived, int64(m))
 				}
 			}(localConn, remoteConn, clientAddr)
+			atomic.AddInt64(&forwarderStats.TotalConnections, 1)
 		}
 		mu.Unlock()
 		remoteConn.Write(buf[:n])
+		atomic.AddInt64(&forwarderStats.BytesSent, int64(n))
 	}
 }
-func relayWs(localConn net.Conn, wsConn *websocket.Conn) {
-	errChan := make(chan error, 2)
-	go func() {
-		bufPtr := bufferPool.Get().(*[]byte)
-		defer bufferPool.Put(bufPtr)
-		buf := *bufPtr
-		for {
-			n, err := localConn.Read(buf)
-			if err != nil {
-				errChan <- err
-				return
-			}
-			if err := wsConn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-				errChan <- err
-				return
-			}
+func wsDataURL(scheme, dataPort, path string) string {
+	u := url.URL{Scheme: scheme, Host: remoteDataAddress(dataPort), Path: path}
+	return u.String()
+}
+func startWsForwarder(f *forwarder, scheme, path string, dialer *websocket.Dialer) (io.Closer, error) {
+	remoteWsAddr := wsDataURL(scheme, f.Port, path)
+	return serveMappings(f, func(header StreamHeader) (io.ReadWriteCloser, error) {
+		wsConn, _, err := dialer.Dial(remoteWsAddr, nil)
+		if err != nil {
+			return nil, err
 		}
-	}()
-	go func() {
-		for {
-			mt, message, err := wsConn.ReadMessage()
-			if err != nil {
-				errChan <- err
-				return
-			}
-			if mt == websocket.BinaryMessage {
-				if _, err := localConn.Write(message); err != nil {
-					errChan <- err
-					return
-				}
-			}
+		if err := writeWsHeader(wsConn, header); err != nil {
+			wsConn.Close()
+			return nil, err
 		}
-	}()
-	<-errChan
+		return &wsConnWrapper{Conn: wsConn}, nil
+	})
 }
-func startWsDataForwarder(dataPort string) {
-	listener, _ := net.Listen("tcp", config.LocalListenPort)
-	defer listener.Close()
-	u := url.URL{Scheme: "ws", Host: config.RemoteServerIP + ":" + dataPort, Path: "/ws"}
-	remoteWsAddr := u.String()
-	for {
-		localConn, err := listener.Accept()
+func startWsDataForwarder(f *forwarder) (io.Closer, error) {
+	return startWsForwarder(f, "ws", "/ws", websocket.DefaultDialer)
+}
+func startWssDataForwarder(f *forwarder) (io.Closer, error) {
+	return startWsForwarder(f, "wss", "/wss", tlsWsDialer())
+}
+func startMuxForwarder(f *forwarder, dial func(dataPort string) (io.ReadWriteCloser, error)) (io.Closer, error) {
+	pool, err := newMuxPool(f, dial)
+	if err != nil {
+		return nil, err
+	}
+	f.mux = pool
+	listener, err := serveMappings(f, func(header StreamHeader) (io.ReadWriteCloser, error) {
+		stream, err := pool.openStream()
 		if err != nil {
-			continue
+			return nil, err
 		}
-		go func(lconn net.Conn) {
-			defer lconn.Close()
-			wsConn, _, err := websocket.DefaultDialer.Dial(remoteWsAddr, nil)
-			if err != nil {
-				return
-			}
-			defer wsConn.Close()
-			relayWs(lconn, wsConn)
-		}(localConn)
+		if err := writeStreamHeader(stream, header); err != nil {
+			stream.Close()
+			return nil, err
+		}
+		return stream, nil
+	})
+	if err != nil {
+		pool.Close()
+		return nil, err
 	}
+	if config.UdpOverMux {
+		udpListeners, err := listenUdpMappings(f)
+		if err != nil {
+			listener.Close()
+			pool.Close()
+			return nil, err
+		}
+		listener.add(udpListeners)
+	}
+	return closerFunc(func() error {
+		err := listener.Close()
+		pool.Close()
+		return err
+	}), nil
 }
-func handleLocalMuxConnection(lconn net.Conn, session *smux.Session) {
-	defer lconn.Close()
-	stream, err := session.OpenStream()
-	if err != nil {
-		return
+func drainMuxSession(session *smux.Session) {
+	deadline := time.Now().Add(muxDrainTimeout)
+	for session.NumStreams() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
 	}
-	defer stream.Close()
-	go relayConnections(stream, lconn)
-	relayConnections(lconn, stream)
+	session.Close()
 }
-func startTcpMuxDataForwarder(dataPort string) {
-	remoteDataAddr := config.RemoteServerIP + ":" + dataPort
-	baseConn, err := net.Dial("tcp", remoteDataAddr)
+func dialTcpMux(dataPort string) (io.ReadWriteCloser, error) {
+	return net.Dial("tcp", remoteDataAddress(dataPort))
+}
+func dialWsMux(dataPort string) (io.ReadWriteCloser, error) {
+	ws, _, err := websocket.DefaultDialer.Dial(wsDataURL("ws", dataPort, "/wsmux"), nil)
 	if err != nil {
-		return
+		return nil, err
 	}
-	session, err := smux.Client(baseConn, nil)
+	return &wsConnWrapper{Conn: ws}, nil
+}
+func dialWssMux(dataPort string) (io.ReadWriteCloser, error) {
+	ws, _, err := tlsWsDialer().Dial(wsDataURL("wss", dataPort, "/wssmux"), nil)
 	if err != nil {
-		return
+		return nil, err
 	}
-	listener, err := net.Listen("tcp", config.LocalListenPort)
-	if err != nil {
-		return
+	return &wsConnWrapper{Conn: ws}, nil
+}
+func adoptKcpParams(params *KcpParams) (KcpConfig, error) {
+	local := config.KcpConfig
+	if params == nil {
+		return local, nil
 	}
-	defer listener.Close()
-	for {
-		localConn, err := listener.Accept()
-		if err != nil {
-			continue
-		}
-		go handleLocalMuxConnection(localConn, session)
+	if params.Crypt != kcpCryptName {
+		return local, fmt.Errorf("server uses KCP crypt '%s' but this client uses '%s'", params.Crypt, kcpCryptName)
+	}
+	adopted := local
+	adopted.Mode = params.Mode
+	adopted.NoDelay = params.NoDelay
+	adopted.Interval = params.Interval
+	adopted.Resend = params.Resend
+	adopted.NoCongestion = params.NoCongestion
+	adopted.SndWnd = params.SndWnd
+	adopted.RcvWnd = params.RcvWnd
+	adopted.DataShards = params.DataShards
+	adopted.ParityShards = params.ParityShards
+	adopted.Mtu = params.Mtu
+	adopted.AckNoDelay = params.AckNoDelay
+	adopted.StreamMode = params.StreamMode
+	adopted.WriteDelay = params.WriteDelay
+	if *newKcpParams(adopted) == *newKcpParams(local) {
+		return local, nil
+	}
+	if config.KcpPinned {
+		return local, fmt.Errorf("server KCP parameters %+v differ from the pinned client ones %+v", *params, *newKcpParams(local))
 	}
+	check := adopted
+	check.Mode = "manual"
+	if _, err := resolveKcpConfig(check); err != nil {
+		return local, fmt.Errorf("server sent invalid KCP parameters: %v", err)
+	}
+	return adopted, nil
 }
-func startWsMuxDataForwarder(dataPort string) {
-	u := url.URL{Scheme: "ws", Host: config.RemoteServerIP + ":" + dataPort, Path: "/wsmux"}
-	remoteWsAddr := u.String()
-	ws, _, err := websocket.DefaultDialer.Dial(remoteWsAddr, nil)
+func dialKcp(dataPort string, kcpConf KcpConfig) (*kcp.UDPSession, error) {
+	conn, err := kcp.DialWithOptions(remoteDataAddress(dataPort), newKcpBlockCrypt(), kcpConf.DataShards, kcpConf.ParityShards)
 	if err != nil {
-		return
+		return nil, err
 	}
-	session, err := smux.Client(&wsConnWrapper{Conn: ws}, nil)
-	if err != nil {
+	tuneKcpSession(conn, kcpConf)
+	tuneKcpSocket(conn, kcpConf)
+	return conn, nil
+}
+func dialUtcpMux(f *forwarder) func(dataPort string) (io.ReadWriteCloser, error) {
+	return func(dataPort string) (io.ReadWriteCloser, error) {
+		return dialKcp(dataPort, f.Kcp)
+	}
+}
+func startTcpMuxDataForwarder(f *forwarder) (io.Closer, error) {
+	return startMuxForwarder(f, dialTcpMux)
+}
+func startWsMuxDataForwarder(f *forwarder) (io.Closer, error) {
+	return startMuxForwarder(f, dialWsMux)
+}
+func startWssMuxDataForwarder(f *forwarder) (io.Closer, error) {
+	return startMuxForwarder(f, dialWssMux)
+}
+func startUtcpMuxDataForwarder(f *forwarder) (io.Closer, error) {
+	return startMuxForwarder(f, dialUtcpMux(f))
+}
+
+var forwarderStarters = map[string]func(f *forwarder) (io.Closer, error){
+	"tcp":     startTcpDataForwarder,
+	"udp":     startUdpDataForwarder,
+	"ws":      startWsDataForwarder,
+	"tcpmux":  startTcpMuxDataForwarder,
+	"wsmux":   startWsMuxDataForwarder,
+	"wss":     startWssDataForwarder,
+	"wssmux":  startWssMuxDataForwarder,
+	"utcpmux": startUtcpMuxDataForwarder,
+}
+
+type forwarder struct {
+	Protocol  string
+	Port      string
+	Kcp       KcpConfig
+	StartedAt time.Time
+	closer    io.Closer
+	mux       *muxPool
+	open      streamOpener
+	failed    int32
+}
+
+var currentForwarder *forwarder
+var forwarderMu sync.Mutex
+var forwarderStats StatsPayload
+
+func (f *forwarder) reportFailure(err error) {
+	if !atomic.CompareAndSwapInt32(&f.failed, 0, 1) {
 		return
 	}
-	listener, err := net.Listen("tcp", config.LocalListenPort)
-	if err != nil {
+	log(fmt.Sprintf("WARN: %s transport to port %s is failing: %v", f.Protocol, f.Port, err))
+	forwarderMu.Lock()
+	isCurrent := currentForwarder == f
+	forwarderMu.Unlock()
+	if !isCurrent {
 		return
 	}
-	defer listener.Close()
-	for {
-		localConn, err := listener.Accept()
-		if err != nil {
-			continue
-		}
-		go func(lconn net.Conn, sess *smux.Session) {
-			handleLocalMuxConnection(lconn, sess)
-		}(localConn, session)
+	if channel := getActiveChannel(); channel != nil {
+		channel.send(msgTransportFailed, TransportFailedPayload{Protocol: f.Protocol, Port: f.Port, Error: err.Error()})
 	}
 }
-func startWssDataForwarder(dataPort string) {
-	listener, _ := net.Listen("tcp", config.LocalListenPort)
-	defer listener.Close()
-	u := url.URL{Scheme: "wss", Host: config.RemoteServerIP + ":" + dataPort, Path: "/wss"}
-	remoteWssAddr := u.String()
-	dialer := websocket.DefaultDialer
-	dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	for {
-		localConn, err := listener.Accept()
-		if err != nil {
-			continue
-		}
-		go func(lconn net.Conn) {
-			defer lconn.Close()
-			wsConn, _, err := dialer.Dial(remoteWssAddr, nil)
-			if err != nil {
-				return
-			}
-			defer wsConn.Close()
-			relayWs(lconn, wsConn)
-		}(localConn)
+func (f *forwarder) openUpstream(header StreamHeader) (io.ReadWriteCloser, error) {
+	if f.open == nil {
+		return nil, fmt.Errorf("%s transport cannot carry streams", f.Protocol)
 	}
-}
-func startWssMuxDataForwarder(dataPort string) {
-	u := url.URL{Scheme: "wss", Host: config.RemoteServerIP + ":" + dataPort, Path: "/wssmux"}
-	remoteWssAddr := u.String()
-	dialer := websocket.DefaultDialer
-	dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	ws, _, err := dialer.Dial(remoteWssAddr, nil)
-	if err != nil {
-		return
+	if header.Target != "" || header.Type == streamUdp {
+		// The server only dials allowlisted targets for streams of an authenticated control session.
+		header.Token = getSessionToken()
 	}
-	session, err := smux.Client(&wsConnWrapper{Conn: ws}, nil)
+	upstream, err := f.open(header)
 	if err != nil {
-		return
+		if err != errMuxClosed {
+			f.reportFailure(err)
+		}
+		return nil, err
 	}
-	listener, err := net.Listen("tcp", config.LocalListenPort)
-	if err != nil {
-		return
+	// The server answers every stream with a status byte once it has dialed the target.
+	if err := readDialStatus(upstream); err != nil {
+		upstream.Close()
+		return nil, err
 	}
-	defer listener.Close()
-	for {
-		localConn, err := listener.Accept()
+	return upstream, nil
+}
+func (f *forwarder) hasFailed() bool {
+	return atomic.LoadInt32(&f.failed) == 1
+}
+func startForwarder(transport TransportPayload) error {
+	protocol, port := transport.Protocol, transport.Port
+	kcpConf := config.KcpConfig
+	if protocol == "utcpmux" {
+		var err error
+		kcpConf, err = adoptKcpParams(transport.Kcp)
 		if err != nil {
-			continue
+			log(fmt.Sprintf("ERROR: KCP parameter mismatch: %v", err))
+			return err
+		}
+		if kcpConf != config.KcpConfig {
+			log(fmt.Sprintf("INFO: Adopted server KCP parameters (mode %s, shards %d/%d, windows %d/%d, mtu %d).", kcpConf.Mode, kcpConf.DataShards, kcpConf.ParityShards, kcpConf.SndWnd, kcpConf.RcvWnd, kcpConf.Mtu))
 		}
-		go func(lconn net.Conn, sess *smux.Session) {
-			handleLocalMuxConnection(lconn, sess)
-		}(localConn, session)
 	}
-}
-func startUtcpMuxDataForwarder(dataPort string) {
-	remoteDataAddr := config.RemoteServerIP + ":" + dataPort
-	kcpConf := config.KcpConfig
-	baseConn, err := kcp.DialWithOptions(remoteDataAddr, nil, kcpConf.DataShards, kcpConf.ParityShards)
-	if err != nil {
-		return
+	forwarderMu.Lock()
+	defer forwarderMu.Unlock()
+	if currentForwarder != nil {
+		if currentForwarder.Protocol == protocol && currentForwarder.Port == port && currentForwarder.Kcp == kcpConf && !currentForwarder.hasFailed() {
+			log(fmt.Sprintf("INFO: %s forwarder to port %s is already running, reusing it.", protocol, port))
+			return nil
+		}
+		log(fmt.Sprintf("INFO: Stopping %s forwarder to port %s.", currentForwarder.Protocol, currentForwarder.Port))
+		currentForwarder.closer.Close()
+		currentForwarder = nil
 	}
-	baseConn.SetNoDelay(kcpConf.NoDelay, kcpConf.Interval, kcpConf.Resend, kcpConf.NoCongestion)
-	baseConn.SetWindowSize(kcpConf.SndWnd, kcpConf.RcvWnd)
-	session, err := smux.Client(baseConn, nil)
-	if err != nil {
-		return
+	start, ok := forwarderStarters[protocol]
+	if !ok {
+		return fmt.Errorf("unknown protocol '%s'", protocol)
 	}
-	listener, err := net.Listen("tcp", config.LocalListenPort)
+	f := &forwarder{Protocol: protocol, Port: port, Kcp: kcpConf, StartedAt: time.Now()}
+	closer, err := start(f)
 	if err != nil {
-		return
+		return err
 	}
-	defer listener.Close()
-	for {
-		localConn, err := listener.Accept()
-		if err != nil {
-			continue
-		}
-		go handleLocalMuxConnection(localConn, session)
+	f.closer = closer
+	currentForwarder = f
+	atomic.StoreInt64(&forwarderStats.TotalConnections, 0)
+	atomic.StoreInt64(&forwarderStats.BytesSent, 0)
+	atomic.StoreInt64(&forwarderStats.BytesReceived, 0)
+	log(fmt.Sprintf("INFO: %s forwarder started on %s -> port %s.", protocol, config.LocalListenPort, port))
+	return nil
+}
+func stopForwarder() bool {
+	forwarderMu.Lock()
+	defer forwarderMu.Unlock()
+	if currentForwarder == nil {
+		return false
 	}
+	log(fmt.Sprintf("INFO: Stopping %s forwarder to port %s.", currentForwarder.Protocol, currentForwarder.Port))
+	currentForwarder.closer.Close()
+	currentForwarder = nil
+	return true
+}
+func currentStats() StatsPayload {
+	forwarderMu.Lock()
+	defer forwarderMu.Unlock()
+	stats := StatsPayload{
+		ActiveConnections: atomic.LoadInt64(&forwarderStats.ActiveConnections),
+		TotalConnections:  atomic.LoadInt64(&forwarderStats.TotalConnections),
+		BytesSent:         atomic.LoadInt64(&forwarderStats.BytesSent),
+		BytesReceived:     atomic.LoadInt64(&forwarderStats.BytesReceived),
+	}
+	if currentForwarder != nil {
+		stats.Protocol = currentForwarder.Protocol
+		stats.Port = currentForwarder.Port
+		stats.UptimeSeconds = int64(time.Since(currentForwarder.StartedAt).Seconds())
+	}
+	return stats
 }
 
 func main() {
 	loadClientConfiguration()
+	if config.AuthKey == "" {
+		log("FATAL: No AuthKey set in client_config.json.")
+		os.Exit(1)
+	}
+	if err := setupKcpCrypt(config.KcpConfig); err != nil {
+		log(fmt.Sprintf("FATAL: Invalid KCP crypto settings: %v", err))
+		os.Exit(1)
+	}
+	kcpConf, err := resolveKcpConfig(config.KcpConfig)
+	if err != nil {
+		log(fmt.Sprintf("FATAL: Invalid KCP settings: %v", err))
+		os.Exit(1)
+	}
+	config.KcpConfig = kcpConf
+	muxConfig, err = buildMuxConfig(config.MuxConfig)
+	if err != nil {
+		log(fmt.Sprintf("FATAL: Invalid MuxConfig: %v", err))
+		os.Exit(1)
+	}
+	if _, err := muxBalance(); err != nil {
+		log(fmt.Sprintf("FATAL: %v", err))
+		os.Exit(1)
+	}
+	if err := validateFrontEnd(); err != nil {
+		log(fmt.Sprintf("FATAL: %v", err))
+		os.Exit(1)
+	}
+	tlsClientConfig, err = loadClientTLSConfig()
+	if err != nil {
+		log(fmt.Sprintf("FATAL: Invalid TLS settings: %v", err))
+		os.Exit(1)
+	}
 	for {
 		log(fmt.Sprintf("Attempting to connect to control server at %s", config.ControlServerAddress))
-		conn, err := net.Dial("tcp", config.ControlServerAddress)
+		conn, err := dialControl()
 		if err != nil {
+			log(fmt.Sprintf("WARN: Control connection failed: %v", err))
 			time.Sleep(5 * time.Second)
 			continue
 		}
 		handleControlConnection(conn)
 		log("INFO: Control connection lost. Will attempt to reconnect.")
+		time.Sleep(5 * time.Second)
 	}
 }
-func handleControlConnection(conn net.Conn) {
-	log("INFO: Successfully connected to control server.")
-	defer conn.Close()
-	reader := json.NewDecoder(conn)
-	for {
-		var msg Message
-		if err := reader.Decode(&msg); err != nil {
-			return
-		}
-		log(fmt.Sprintf("Received command: '%s'", msg.Command))
-		var configData TransportConfig
-		json.Unmarshal([]byte(msg.Payload), &configData)
-		switch configData.Protocol {
-		case "tcp":
-			go startTcpDataForwarder(configData.Port)
-		case "udp":
-			go startUdpDataForwarder(configData.Port)
-		case "ws":
-			go startWsDataForwarder(configData.Port)
-		case "tcpmux":
-			go startTcpMuxDataForwarder(configData.Port)
-		case "wsmux":
-			go startWsMuxDataForwarder(configData.Port)
-		case "wss":
-			go startWssDataForwarder(configData.Port)
-		case "wssmux":
-			go startWssMuxDataForwarder(configData.Port)
-		case "utcpmux":
-			go startUtcpMuxDataForwarder(configData.Port)
-		}
-	}
-}
\ No newline at end of file
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const controlDialTimeout = 10 * time.Second
+
+func dialControl() (net.Conn, error) {
+	path := config.ControlPath
+	if path == "" {
+		path = "/control"
+	}
+	switch strings.ToLower(config.ControlTransport) {
+	case "", "tcp":
+		return net.DialTimeout("tcp", config.ControlServerAddress, controlDialTimeout)
+	case "tls":
+		dialer := &net.Dialer{Timeout: controlDialTimeout}
+		return tls.DialWithDialer(dialer, "tcp", config.ControlServerAddress, tlsClientConfig.Clone())
+	case "ws":
+		return dialWsControl(websocket.DefaultDialer, "ws", path)
+	case "wss":
+		return dialWsControl(tlsWsDialer(), "wss", path)
+	}
+	return nil, fmt.Errorf("unknown control transport %q", config.ControlTransport)
+}
+func dialWsControl(dialer *websocket.Dialer, scheme, path string) (net.Conn, error) {
+	u := url.URL{Scheme: scheme, Host: config.ControlServerAddress, Path: path}
+	ws, _, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &wsConnWrapper{Conn: ws}, nil
+}
+
+type controlChannel struct {
+	conn     net.Conn
+	writer   *json.Encoder
+	writeMu  sync.Mutex
+	nextID   uint64
+	lastSeen int64
+	peerDead int32
+}
+
+func (c *controlChannel) send(msgType string, payload interface{}) (uint64, error) {
+	msg, err := newMessage(msgType, payload)
+	if err != nil {
+		return 0, err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.nextID++
+	msg.ID = c.nextID
+	c.conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+	return msg.ID, c.writer.Encode(msg)
+}
+func (c *controlChannel) reply(replyTo uint64, msgType string, payload interface{}) error {
+	msg, err := newMessage(msgType, payload)
+	if err != nil {
+		return err
+	}
+	msg.ReplyTo = replyTo
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+	return c.writer.Encode(msg)
+}
+func (c *controlChannel) replyError(replyTo uint64, code, message string) error {
+	return c.reply(replyTo, msgError, ErrorPayload{Code: code, Message: message})
+}
+
+const controlWriteTimeout = 30 * time.Second
+
+var activeChannel *controlChannel
+var activeChannelMu sync.Mutex
+
+func getActiveChannel() *controlChannel {
+	activeChannelMu.Lock()
+	defer activeChannelMu.Unlock()
+	return activeChannel
+}
+func setActiveChannel(channel *controlChannel) {
+	activeChannelMu.Lock()
+	defer activeChannelMu.Unlock()
+	activeChannel = channel
+}
+func getSessionToken() string {
+	sessionTokenMu.Lock()
+	defer sessionTokenMu.Unlock()
+	return sessionToken
+}
+func setSessionToken(token string) {
+	sessionTokenMu.Lock()
+	defer sessionTokenMu.Unlock()
+	sessionToken = token
+}
+func clientCapabilities() []string {
+	capabilities := []string{"resume", "stats", "probe"}
+	for name := range forwarderStarters {
+		capabilities = append(capabilities, name)
+	}
+	sort.Strings(capabilities)
+	return capabilities
+}
+func handleControlConnection(conn net.Conn) {
+	defer conn.Close()
+	writer := json.NewEncoder(conn)
+	reader := json.NewDecoder(conn)
+	if err := authenticateServer(conn, writer, reader); err != nil {
+		log(fmt.Sprintf("ERROR: Control server authentication failed: %v", err))
+		return
+	}
+	hello := HelloPayload{
+		Version:      protocolVersion,
+		MinVersion:   minProtocolVersion,
+		Capabilities: clientCapabilities(),
+		SessionToken: getSessionToken(),
+		KcpCrypt:     kcpCryptFingerprint,
+		Reverse:      reverseMappingNames(),
+	}
+	if err := writeMessage(writer, msgHello, hello); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	var reply HelloPayload
+	if err := readMessage(reader, msgHello, &reply); err != nil {
+		var perr *peerError
+		if errors.As(err, &perr) && perr.Code == errKcpCryptMismatch {
+			log("FATAL: KcpConfig Crypt/Key do not match the server. Fix client_config.json and restart.")
+			os.Exit(1)
+		}
+		log(fmt.Sprintf("ERROR: Control server rejected hello: %v", err))
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if _, err := negotiateVersion(reply); err != nil {
+		log(fmt.Sprintf("ERROR: Incompatible control server: %v", err))
+		return
+	}
+	if reply.Resumed {
+		log(fmt.Sprintf("INFO: Resumed session %s (protocol v%d).", reply.SessionID, reply.Version))
+	} else {
+		log(fmt.Sprintf("INFO: Started new session %s (protocol v%d).", reply.SessionID, reply.Version))
+	}
+	setSessionToken(reply.SessionToken)
+	if !reply.Resumed {
+		rebindReverse()
+	}
+	log("INFO: Successfully connected to control server.")
+	channel := &controlChannel{conn: conn, writer: writer}
+	setActiveChannel(channel)
+	defer setActiveChannel(nil)
+	channel.markSeen()
+	done := make(chan struct{})
+	defer close(done)
+	go channel.heartbeat(conn, done)
+	for {
+		var msg Message
+		if err := reader.Decode(&msg); err != nil {
+			break
+		}
+		channel.markSeen()
+		handleControlMessage(channel, msg)
+	}
+	if atomic.LoadInt32(&channel.peerDead) == 1 && stopForwarder() {
+		log("INFO: Data transport torn down with the dead control session.")
+	}
+}
+func handleControlMessage(channel *controlChannel, msg Message) {
+	if msg.Type != msgPing && msg.Type != msgPong {
+		log(fmt.Sprintf("Received message: '%s'", msg.Type))
+	}
+	switch msg.Type {
+	case msgStartTransport, msgSwitchTransport:
+		var transport TransportPayload
+		if err := decodePayload(msg, &transport); err != nil {
+			log(fmt.Sprintf("ERROR: %v", err))
+			channel.replyError(msg.ID, errBadPayload, err.Error())
+			return
+		}
+		if err := startForwarder(transport); err != nil {
+			log(fmt.Sprintf("ERROR: Could not start %s forwarder: %v", transport.Protocol, err))
+			channel.replyError(msg.ID, "transport_failed", err.Error())
+			return
+		}
+		channel.reply(msg.ID, msgAck, nil)
+	case msgProbeTransports:
+		var probe ProbeRequestPayload
+		if err := decodePayload(msg, &probe); err != nil {
+			channel.replyError(msg.ID, errBadPayload, err.Error())
+			return
+		}
+		go func() {
+			channel.reply(msg.ID, msgProbeResult, ProbeResultPayload{Results: probeTransports(probe.Transports)})
+		}()
+	case msgStopTransport:
+		stopForwarder()
+		channel.reply(msg.ID, msgAck, nil)
+	case msgPing:
+		var ping PingPayload
+		if err := decodePayload(msg, &ping); err != nil {
+			channel.replyError(msg.ID, errBadPayload, err.Error())
+			return
+		}
+		channel.reply(msg.ID, msgPong, ping)
+	case msgPong:
+		channel.handlePong(msg)
+	case msgStats:
+		channel.reply(msg.ID, msgStats, currentStats())
+	case msgError:
+		var e ErrorPayload
+		decodePayload(msg, &e)
+		log(fmt.Sprintf("ERROR: Control server reported %s: %s", e.Code, e.Message))
+	default:
+		log(fmt.Sprintf("WARN: Unknown message type '%s' from control server.", msg.Type))
+		channel.replyError(msg.ID, errUnknownType, fmt.Sprintf("unknown message type '%s'", msg.Type))
+	}
+}
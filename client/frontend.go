@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const frontEndHandshakeTimeout = 10 * time.Second
+
+const (
+	socksVersion      = 0x05
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksNoMethods    = 0xff
+	socksCmdConnect   = 0x01
+	socksCmdAssociate = 0x03
+	socksAtypIPv4     = 0x01
+	socksAtypDomain   = 0x03
+	socksAtypIPv6     = 0x04
+	socksSucceeded    = 0x00
+	socksFailure      = 0x01
+	socksNotAllowed   = 0x02
+	socksConnRefused  = 0x05
+	socksCmdNotSupp   = 0x07
+	socksAtypNotSupp  = 0x08
+)
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+func validateFrontEnd() error {
+	switch strings.ToLower(config.FrontEnd) {
+	case "", "socks5", "http", "mixed":
+		return nil
+	}
+	return fmt.Errorf("unknown FrontEnd '%s' (use socks5, http or mixed)", config.FrontEnd)
+}
+func serveFrontEnd(f *forwarder, lconn net.Conn) {
+	conn := &bufferedConn{Conn: lconn, reader: bufio.NewReader(lconn)}
+	conn.SetReadDeadline(time.Now().Add(frontEndHandshakeTimeout))
+	mode := strings.ToLower(config.FrontEnd)
+	if mode == "mixed" {
+		first, err := conn.reader.Peek(1)
+		if err != nil {
+			return
+		}
+		mode = "http"
+		if first[0] == socksVersion {
+			mode = "socks5"
+		}
+	}
+	var err error
+	if mode == "socks5" {
+		err = serveSocks5(f, conn)
+	} else {
+		err = serveHttpConnect(f, conn)
+	}
+	if err != nil && err != io.EOF {
+		log(fmt.Sprintf("WARN: %s front-end request from %s failed: %v", mode, lconn.RemoteAddr().String(), err))
+	}
+}
+func proxyCredentialsMatch(username, password string) bool {
+	userOk := subtle.ConstantTimeCompare([]byte(username), []byte(config.ProxyUsername)) == 1
+	passOk := subtle.ConstantTimeCompare([]byte(password), []byte(config.ProxyPassword)) == 1
+	return userOk && passOk
+}
+func serveHttpConnect(f *forwarder, conn *bufferedConn) error {
+	request, err := http.ReadRequest(conn.reader)
+	if err != nil {
+		return err
+	}
+	if config.ProxyUsername != "" {
+		username, password, ok := parseProxyAuthorization(request.Header.Get("Proxy-Authorization"))
+		if !ok || !proxyCredentialsMatch(username, password) {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"g-tun\"\r\nContent-Length: 0\r\n\r\n")
+			return errors.New("proxy authentication failed")
+		}
+	}
+	if request.Method != http.MethodConnect {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\nContent-Length: 0\r\n\r\n")
+		return fmt.Errorf("unsupported method %s", request.Method)
+	}
+	target := request.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "443")
+	}
+	upstream, err := f.openUpstream(StreamHeader{Type: streamConnect, Target: target})
+	if err != nil {
+		if errors.Is(err, errTargetDenied) {
+			io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+		} else {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		}
+		return err
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		upstream.Close()
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	relayUpstream(conn, upstream)
+	return nil
+}
+func parseProxyAuthorization(value string) (string, string, bool) {
+	scheme, encoded, found := strings.Cut(value, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+func serveSocks5(f *forwarder, conn *bufferedConn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn.reader, header); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn.reader, methods); err != nil {
+		return err
+	}
+	method := byte(socksAuthNone)
+	if config.ProxyUsername != "" {
+		method = socksAuthPassword
+	}
+	if !strings.Contains(string(methods), string([]byte{method})) {
+		conn.Write([]byte{socksVersion, socksNoMethods})
+		return errors.New("client offered no acceptable SOCKS auth method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return err
+	}
+	if method == socksAuthPassword {
+		if err := socksPasswordAuth(conn); err != nil {
+			return err
+		}
+	}
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(conn.reader, request); err != nil {
+		return err
+	}
+	target, err := readSocksAddr(conn.reader)
+	if err != nil {
+		writeSocksReply(conn, socksAtypNotSupp, nil)
+		return err
+	}
+	switch request[1] {
+	case socksCmdConnect:
+		upstream, err := f.openUpstream(StreamHeader{Type: streamConnect, Target: target})
+		if err != nil {
+			writeSocksReply(conn, socksReplyStatus(err), nil)
+			return err
+		}
+		if err := writeSocksReply(conn, socksSucceeded, conn.LocalAddr()); err != nil {
+			upstream.Close()
+			return err
+		}
+		conn.SetReadDeadline(time.Time{})
+		relayUpstream(conn, upstream)
+		return nil
+	case socksCmdAssociate:
+		return serveSocksAssociate(f, conn, target)
+	}
+	writeSocksReply(conn, socksCmdNotSupp, nil)
+	return fmt.Errorf("unsupported SOCKS command %d", request[1])
+}
+func socksPasswordAuth(conn *bufferedConn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn.reader, header); err != nil {
+		return err
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn.reader, username); err != nil {
+		return err
+	}
+	var size [1]byte
+	if _, err := io.ReadFull(conn.reader, size[:]); err != nil {
+		return err
+	}
+	password := make([]byte, size[0])
+	if _, err := io.ReadFull(conn.reader, password); err != nil {
+		return err
+	}
+	if !proxyCredentialsMatch(string(username), string(password)) {
+		conn.Write([]byte{0x01, 0x01})
+		return errors.New("SOCKS authentication failed")
+	}
+	_, err := conn.Write([]byte{0x01, 0x00})
+	return err
+}
+func readSocksAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		var size [1]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unsupported SOCKS address type %d", atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+func appendSocksAddr(b []byte, addr string) []byte {
+	host, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		return append(b, socksAtypIPv4, 0, 0, 0, 0, 0, 0)
+	}
+	port, _ := strconv.Atoi(portText)
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(append(b, socksAtypIPv4), ip4...)
+		} else {
+			b = append(append(b, socksAtypIPv6), ip.To16()...)
+		}
+	} else {
+		b = append(append(b, socksAtypDomain, byte(len(host))), host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+func socksReplyStatus(err error) byte {
+	switch {
+	case errors.Is(err, errTargetDenied):
+		return socksNotAllowed
+	case errors.Is(err, errTargetUnreachable):
+		return socksConnRefused
+	}
+	return socksFailure
+}
+func writeSocksReply(w io.Writer, status byte, bound net.Addr) error {
+	reply := []byte{socksVersion, status, 0x00}
+	addr := "0.0.0.0:0"
+	if bound != nil {
+		addr = bound.String()
+	}
+	_, err := w.Write(appendSocksAddr(reply, addr))
+	return err
+}
+func socksAssociateSource(conn net.Conn, requested string) (net.IP, int, error) {
+	clientHost, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil, 0, err
+	}
+	clientIP := net.ParseIP(clientHost)
+	host, portText, err := net.SplitHostPort(requested)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, _ := strconv.Atoi(portText)
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && !ip.Equal(clientIP) {
+		return nil, 0, fmt.Errorf("UDP ASSOCIATE for %s does not match client %s", requested, clientIP)
+	}
+	return clientIP, port, nil
+}
+func serveSocksAssociate(f *forwarder, conn *bufferedConn, requested string) error {
+	sourceIP, sourcePort, err := socksAssociateSource(conn, requested)
+	if err != nil {
+		writeSocksReply(conn, socksFailure, nil)
+		return err
+	}
+	localHost, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(localHost)})
+	if err != nil {
+		writeSocksReply(conn, socksFailure, nil)
+		return err
+	}
+	defer udpConn.Close()
+	upstream, err := f.openUpstream(StreamHeader{Type: streamUdp})
+	if err != nil {
+		writeSocksReply(conn, socksReplyStatus(err), nil)
+		return err
+	}
+	defer upstream.Close()
+	if err := writeSocksReply(conn, socksSucceeded, udpConn.LocalAddr()); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	var clientAddr *net.UDPAddr
+	var clientMu sync.Mutex
+	go func() {
+		for {
+			source, payload, err := readDatagram(upstream)
+			if err != nil {
+				// The server ends idle associations; closing the TCP connection tells the SOCKS client.
+				udpConn.Close()
+				conn.Close()
+				return
+			}
+			clientMu.Lock()
+			addr := clientAddr
+			clientMu.Unlock()
+			if addr == nil {
+				continue
+			}
+			packet := appendSocksAddr([]byte{0x00, 0x00, 0x00}, source)
+			udpConn.WriteToUDP(append(packet, payload...), addr)
+		}
+	}()
+	go func() {
+		defer udpConn.Close()
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			// Only the TCP client may use the association, and only from one source port.
+			if !from.IP.Equal(sourceIP) || (sourcePort != 0 && from.Port != sourcePort) {
+				continue
+			}
+			clientMu.Lock()
+			if clientAddr != nil && clientAddr.Port != from.Port {
+				clientMu.Unlock()
+				continue
+			}
+			clientAddr = from
+			clientMu.Unlock()
+			// Fragmented datagrams are rarely used and may be dropped per RFC 1928.
+			if n < 4 || buf[2] != 0x00 {
+				continue
+			}
+			reader := bytes.NewReader(buf[3:n])
+			target, err := readSocksAddr(reader)
+			if err != nil {
+				continue
+			}
+			payload := buf[n-reader.Len() : n]
+			if err := writeDatagram(upstream, target, payload); err != nil {
+				return
+			}
+		}
+	}()
+	// The association lives as long as the TCP control connection stays open.
+	io.Copy(io.Discard, conn)
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestReadSocksAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		want    string
+		wantErr bool
+	}{
+		{"ipv4", []byte{socksAtypIPv4, 192, 0, 2, 1, 0x00, 0x50}, "192.0.2.1:80", false},
+		{"ipv6", append(append([]byte{socksAtypIPv6}, net.ParseIP("2001:db8::1")...), 0x01, 0xbb), "[2001:db8::1]:443", false},
+		{"domain", append(append([]byte{socksAtypDomain, 11}, "example.com"...), 0x1f, 0x90), "example.com:8080", false},
+		{"unknown type", []byte{0x05, 0, 0}, "", true},
+		{"truncated ipv4", []byte{socksAtypIPv4, 192, 0}, "", true},
+		{"truncated domain", append([]byte{socksAtypDomain, 11}, "exam"...), "", true},
+		{"missing port", []byte{socksAtypIPv4, 192, 0, 2, 1, 0x00}, "", true},
+		{"empty", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readSocksAddr(bytes.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readSocksAddr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("readSocksAddr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+func TestAppendSocksAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		addr string
+		want []byte
+	}{
+		{"ipv4", "192.0.2.1:80", []byte{socksAtypIPv4, 192, 0, 2, 1, 0x00, 0x50}},
+		{"ipv6", "[2001:db8::1]:443", append(append([]byte{socksAtypIPv6}, net.ParseIP("2001:db8::1")...), 0x01, 0xbb)},
+		{"domain", "example.com:8080", append(append([]byte{socksAtypDomain, 11}, "example.com"...), 0x1f, 0x90)},
+		{"invalid", "not-an-address", []byte{socksAtypIPv4, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := appendSocksAddr(nil, tt.addr)
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("appendSocksAddr(%q) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+func TestParseProxyAuthorization(t *testing.T) {
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	tests := []struct {
+		name     string
+		value    string
+		username string
+		password string
+		ok       bool
+	}{
+		{"basic", "Basic " + encode("user:pass"), "user", "pass", true},
+		{"scheme case", "basic " + encode("user:pass"), "user", "pass", true},
+		{"colon in password", "Basic " + encode("user:pa:ss"), "user", "pa:ss", true},
+		{"empty password", "Basic " + encode("user:"), "user", "", true},
+		{"no colon", "Basic " + encode("user"), "user", "", false},
+		{"other scheme", "Bearer " + encode("user:pass"), "", "", false},
+		{"bad base64", "Basic !!!", "", "", false},
+		{"empty", "", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username, password, ok := parseProxyAuthorization(tt.value)
+			if ok != tt.ok || (ok && (username != tt.username || password != tt.password)) {
+				t.Fatalf("parseProxyAuthorization() = %q, %q, %v, want %q, %q, %v", username, password, ok, tt.username, tt.password, tt.ok)
+			}
+		})
+	}
+}
+
+type remoteAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteAddrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+func TestSocksAssociateSource(t *testing.T) {
+	conn := remoteAddrConn{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 40000}}
+	tests := []struct {
+		name      string
+		requested string
+		wantPort  int
+		wantErr   bool
+	}{
+		{"unspecified", "0.0.0.0:0", 0, false},
+		{"port only", "0.0.0.0:5353", 5353, false},
+		{"client ip", "192.0.2.10:5353", 5353, false},
+		{"other ip", "198.51.100.7:5353", 0, true},
+		{"domain", "client.example:5353", 5353, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, port, err := socksAssociateSource(conn, tt.requested)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("socksAssociateSource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !ip.Equal(net.ParseIP("192.0.2.10")) || port != tt.wantPort {
+				t.Fatalf("socksAssociateSource() = %s, %d, want 192.0.2.10, %d", ip, port, tt.wantPort)
+			}
+		})
+	}
+}
+func TestFrontEndDialStatus(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = ClientConfig{}
+	tests := []struct {
+		name      string
+		status    byte
+		wantHttp  int
+		wantSocks byte
+	}{
+		{"connected", dialOk, http.StatusOK, socksSucceeded},
+		{"denied", dialDenied, http.StatusForbidden, socksNotAllowed},
+		{"unreachable", dialFailed, http.StatusBadGateway, socksConnRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &forwarder{open: func(header StreamHeader) (io.ReadWriteCloser, error) {
+				upstream, server := net.Pipe()
+				go func() {
+					server.Write([]byte{tt.status})
+					server.Close()
+				}()
+				return upstream, nil
+			}}
+			local, remote := net.Pipe()
+			go serveHttpConnect(f, &bufferedConn{Conn: local, reader: bufio.NewReader(local)})
+			io.WriteString(remote, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+			response, err := http.ReadResponse(bufio.NewReader(remote), nil)
+			remote.Close()
+			if err != nil || response.StatusCode != tt.wantHttp {
+				t.Fatalf("HTTP CONNECT response = %v, %v, want status %d", response, err, tt.wantHttp)
+			}
+			local, remote = net.Pipe()
+			go serveSocks5(f, &bufferedConn{Conn: local, reader: bufio.NewReader(local)})
+			defer remote.Close()
+			remote.Write([]byte{socksVersion, 1, socksAuthNone})
+			method := make([]byte, 2)
+			if _, err := io.ReadFull(remote, method); err != nil {
+				t.Fatal(err)
+			}
+			remote.Write([]byte{socksVersion, socksCmdConnect, 0x00, socksAtypIPv4, 192, 0, 2, 1, 0x00, 0x50})
+			reply := make([]byte, 10)
+			if _, err := io.ReadFull(remote, reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply[1] != tt.wantSocks {
+				t.Fatalf("SOCKS reply = %d, want %d", reply[1], tt.wantSocks)
+			}
+		})
+	}
+}
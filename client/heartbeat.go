@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const defaultHeartbeatInterval = 15
+const defaultHeartbeatTimeout = 45
+
+func heartbeatSettings() (time.Duration, time.Duration) {
+	interval := config.HeartbeatInterval
+	if interval <= 0 {
+		interval = defaultHeartbeatInterval
+	}
+	timeout := config.HeartbeatTimeout
+	if timeout <= 0 {
+		timeout = defaultHeartbeatTimeout
+	}
+	if timeout < interval {
+		timeout = interval * 3
+	}
+	return time.Duration(interval) * time.Second, time.Duration(timeout) * time.Second
+}
+func (c *controlChannel) markSeen() {
+	atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
+}
+func (c *controlChannel) heartbeat(conn net.Conn, done chan struct{}) {
+	interval, timeout := heartbeatSettings()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		silence := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastSeen)))
+		if silence > timeout {
+			log(fmt.Sprintf("WARN: No heartbeat from control server for %s, declaring it dead.", silence.Round(time.Second)))
+			atomic.StoreInt32(&c.peerDead, 1)
+			conn.Close()
+			return
+		}
+		if _, err := c.send(msgPing, PingPayload{Timestamp: time.Now().UnixNano()}); err != nil {
+			return
+		}
+	}
+}
+func (c *controlChannel) handlePong(msg Message) {
+	var pong PingPayload
+	if err := decodePayload(msg, &pong); err != nil {
+		return
+	}
+	rtt := time.Since(time.Unix(0, pong.Timestamp))
+	log(fmt.Sprintf("HEARTBEAT: control server RTT %s", rtt.Round(time.Microsecond)))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+type kcpPreset struct {
+	NoDelay      int
+	Interval     int
+	Resend       int
+	NoCongestion int
+}
+
+var kcpPresets = map[string]kcpPreset{
+	"normal": {0, 40, 2, 1},
+	"fast":   {0, 30, 2, 1},
+	"fast2":  {1, 20, 2, 1},
+	"fast3":  {1, 10, 2, 1},
+}
+
+func resolveKcpConfig(kcpConf KcpConfig) (KcpConfig, error) {
+	mode := strings.ToLower(kcpConf.Mode)
+	if mode == "" {
+		mode = "manual"
+	}
+	if mode != "manual" {
+		preset, ok := kcpPresets[mode]
+		if !ok {
+			return kcpConf, fmt.Errorf("unknown KcpConfig.Mode '%s' (use normal, fast, fast2, fast3 or manual)", kcpConf.Mode)
+		}
+		kcpConf.NoDelay = preset.NoDelay
+		kcpConf.Interval = preset.Interval
+		kcpConf.Resend = preset.Resend
+		kcpConf.NoCongestion = preset.NoCongestion
+	}
+	kcpConf.Mode = mode
+	if kcpConf.Mtu != 0 && (kcpConf.Mtu < 576 || kcpConf.Mtu > 1500) {
+		return kcpConf, fmt.Errorf("KcpConfig.Mtu must be between 576 and 1500, got %d", kcpConf.Mtu)
+	}
+	if kcpConf.Dscp < 0 || kcpConf.Dscp > 63 {
+		return kcpConf, fmt.Errorf("KcpConfig.Dscp must be between 0 and 63, got %d", kcpConf.Dscp)
+	}
+	if kcpConf.ReadBuffer < 0 || kcpConf.WriteBuffer < 0 {
+		return kcpConf, fmt.Errorf("KcpConfig.ReadBuffer and WriteBuffer must not be negative")
+	}
+	return kcpConf, nil
+}
+func tuneKcpSession(conn *kcp.UDPSession, kcpConf KcpConfig) {
+	conn.SetNoDelay(kcpConf.NoDelay, kcpConf.Interval, kcpConf.Resend, kcpConf.NoCongestion)
+	conn.SetWindowSize(kcpConf.SndWnd, kcpConf.RcvWnd)
+	if kcpConf.Mtu > 0 {
+		conn.SetMtu(kcpConf.Mtu)
+	}
+	conn.SetACKNoDelay(kcpConf.AckNoDelay)
+	conn.SetStreamMode(kcpConf.StreamMode)
+	conn.SetWriteDelay(kcpConf.WriteDelay)
+}
+func tuneKcpSocket(conn interface {
+	SetDSCP(int) error
+	SetReadBuffer(int) error
+	SetWriteBuffer(int) error
+}, kcpConf KcpConfig) {
+	if kcpConf.Dscp > 0 {
+		if err := conn.SetDSCP(kcpConf.Dscp); err != nil {
+			log(fmt.Sprintf("WARN: Could not set KCP DSCP %d: %v", kcpConf.Dscp, err))
+		}
+	}
+	if kcpConf.ReadBuffer > 0 {
+		if err := conn.SetReadBuffer(kcpConf.ReadBuffer); err != nil {
+			log(fmt.Sprintf("WARN: Could not set KCP read buffer: %v", err))
+		}
+	}
+	if kcpConf.WriteBuffer > 0 {
+		if err := conn.SetWriteBuffer(kcpConf.WriteBuffer); err != nil {
+			log(fmt.Sprintf("WARN: Could not set KCP write buffer: %v", err))
+		}
+	}
+}
+func newKcpParams(kcpConf KcpConfig) *KcpParams {
+	crypt := kcpConf.Crypt
+	if crypt == "" {
+		crypt = "none"
+	}
+	return &KcpParams{
+		Mode:         kcpConf.Mode,
+		NoDelay:      kcpConf.NoDelay,
+		Interval:     kcpConf.Interval,
+		Resend:       kcpConf.Resend,
+		NoCongestion: kcpConf.NoCongestion,
+		SndWnd:       kcpConf.SndWnd,
+		RcvWnd:       kcpConf.RcvWnd,
+		DataShards:   kcpConf.DataShards,
+		ParityShards: kcpConf.ParityShards,
+		Mtu:          kcpConf.Mtu,
+		AckNoDelay:   kcpConf.AckNoDelay,
+		StreamMode:   kcpConf.StreamMode,
+		WriteDelay:   kcpConf.WriteDelay,
+		Crypt:        strings.ToLower(crypt),
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestAdoptKcpParams(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	local := KcpConfig{Mode: "fast", NoDelay: 0, Interval: 30, Resend: 2, NoCongestion: 1, SndWnd: 128, RcvWnd: 512, DataShards: 10, ParityShards: 3}
+	server := *newKcpParams(local)
+	server.Mode, server.NoDelay, server.Interval, server.SndWnd, server.RcvWnd, server.Mtu = "fast3", 1, 10, 1024, 1024, 1400
+	tests := []struct {
+		name    string
+		params  *KcpParams
+		pinned  bool
+		want    KcpConfig
+		wantErr bool
+	}{
+		{"no params", nil, false, local, false},
+		{"same params", newKcpParams(local), true, local, false},
+		{"server params adopted", &server, false, KcpConfig{Mode: "fast3", NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1, SndWnd: 1024, RcvWnd: 1024, DataShards: 10, ParityShards: 3, Mtu: 1400}, false},
+		{"pinned client", &server, true, local, true},
+		{"crypt mismatch", &KcpParams{Crypt: "aes"}, false, local, true},
+		{"invalid mtu", &KcpParams{Mtu: 100, Crypt: "none"}, false, local, true},
+	}
+	if err := setupKcpCrypt(KcpConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.KcpConfig = local
+			config.KcpPinned = tt.pinned
+			got, err := adoptKcpParams(tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("adoptKcpParams() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("adoptKcpParams() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
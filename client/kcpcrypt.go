@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/xtaci/kcp-go/v5"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const kcpKeySalt = "kcp-go"
+const kcpKeyIterations = 4096
+
+type kcpCipher struct {
+	KeySize int
+	New     func(key []byte) (kcp.BlockCrypt, error)
+}
+
+var kcpCiphers = map[string]kcpCipher{
+	"aes":      {32, kcp.NewAESBlockCrypt},
+	"aes-128":  {16, kcp.NewAESBlockCrypt},
+	"aes-192":  {24, kcp.NewAESBlockCrypt},
+	"salsa20":  {32, kcp.NewSalsa20BlockCrypt},
+	"chacha20": {32, newChacha20BlockCrypt},
+	"blowfish": {32, kcp.NewBlowfishBlockCrypt},
+	"twofish":  {32, kcp.NewTwofishBlockCrypt},
+	"cast5":    {16, kcp.NewCast5BlockCrypt},
+	"3des":     {24, kcp.NewTripleDESBlockCrypt},
+	"tea":      {16, kcp.NewTEABlockCrypt},
+	"xtea":     {16, kcp.NewXTEABlockCrypt},
+	"sm4":      {16, kcp.NewSM4BlockCrypt},
+	"xor":      {32, kcp.NewSimpleXORBlockCrypt},
+}
+var kcpCryptName string
+var kcpCryptKey []byte
+var kcpCryptFingerprint string
+
+type chacha20BlockCrypt struct {
+	key []byte
+}
+
+func newChacha20BlockCrypt(key []byte) (kcp.BlockCrypt, error) {
+	if len(key) != chacha20.KeySize {
+		return nil, fmt.Errorf("chacha20 needs a %d byte key", chacha20.KeySize)
+	}
+	return &chacha20BlockCrypt{key: key}, nil
+}
+func (c *chacha20BlockCrypt) Encrypt(dst, src []byte) {
+	c.xor(dst, src)
+}
+func (c *chacha20BlockCrypt) Decrypt(dst, src []byte) {
+	c.xor(dst, src)
+}
+func (c *chacha20BlockCrypt) xor(dst, src []byte) {
+	// kcp-go prefixes every packet with a random nonce, the first 12 bytes of it seed the keystream.
+	stream, err := chacha20.NewUnauthenticatedCipher(c.key, src[:chacha20.NonceSize])
+	if err != nil {
+		return
+	}
+	stream.XORKeyStream(dst[chacha20.NonceSize:], src[chacha20.NonceSize:])
+	copy(dst[:chacha20.NonceSize], src[:chacha20.NonceSize])
+}
+func setupKcpCrypt(kcpConf KcpConfig) error {
+	name := strings.ToLower(kcpConf.Crypt)
+	if name == "" {
+		name = "none"
+	}
+	kcpCryptName = name
+	kcpCryptKey = nil
+	if name == "none" {
+		kcpCryptFingerprint = kcpFingerprint(name, nil)
+		return nil
+	}
+	spec, ok := kcpCiphers[name]
+	if !ok {
+		return fmt.Errorf("unknown KcpConfig.Crypt '%s'", kcpConf.Crypt)
+	}
+	secret := kcpConf.Key
+	if secret == "" {
+		secret = config.AuthKey
+	}
+	kcpCryptKey = pbkdf2.Key([]byte(secret), []byte(kcpKeySalt), kcpKeyIterations, spec.KeySize, sha1.New)
+	if _, err := spec.New(kcpCryptKey); err != nil {
+		return err
+	}
+	kcpCryptFingerprint = kcpFingerprint(name, kcpCryptKey)
+	return nil
+}
+func kcpFingerprint(name string, key []byte) string {
+	digest := sha256.Sum256(append([]byte("g-tun kcp "+name+" "), key...))
+	return hex.EncodeToString(digest[:8])
+}
+func newKcpBlockCrypt() kcp.BlockCrypt {
+	if kcpCryptKey == nil {
+		return nil
+	}
+	block, _ := kcpCiphers[kcpCryptName].New(kcpCryptKey)
+	return block
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const dialStatusTimeout = 30 * time.Second
+
+var errTargetDenied = errors.New("server does not allow this target")
+var errTargetUnreachable = errors.New("server could not reach the target")
+
+type streamOpener func(header StreamHeader) (io.ReadWriteCloser, error)
+type LocalMapping struct {
+	Name          string
+	ListenAddress string
+	Target        string
+}
+
+type mappingEndpoint struct {
+	address string
+	header  StreamHeader
+}
+
+func mappingEndpoints(streamType string) []mappingEndpoint {
+	var endpoints []mappingEndpoint
+	if config.LocalListenPort != "" {
+		endpoints = append(endpoints, mappingEndpoint{config.LocalListenPort, StreamHeader{Type: streamType}})
+	}
+	for _, mapping := range config.Mappings {
+		header := StreamHeader{Type: streamType, Mapping: mapping.Name}
+		if mapping.Target != "" {
+			// Dynamic targets are resolved against the server's TargetAllowlist instead of a named mapping.
+			header = StreamHeader{Type: streamType, Target: mapping.Target}
+		}
+		endpoints = append(endpoints, mappingEndpoint{mapping.ListenAddress, header})
+	}
+	return endpoints
+}
+func listenMappings(handle func(lconn net.Conn, header StreamHeader)) (*closerList, error) {
+	listeners := &closerList{}
+	for _, endpoint := range mappingEndpoints(streamConnect) {
+		listener, err := net.Listen("tcp", endpoint.address)
+		if err != nil {
+			listeners.Close()
+			return nil, err
+		}
+		listeners.add(listener)
+		header := endpoint.header
+		go serveLocalConnections(listener, func(lconn net.Conn) {
+			handle(lconn, header)
+		})
+	}
+	if len(listeners.closers) == 0 {
+		return nil, errors.New("no LocalListenPort or Mappings configured")
+	}
+	return listeners, nil
+}
+func serveMappings(f *forwarder, open streamOpener) (*closerList, error) {
+	f.open = open
+	return listenMappings(func(lconn net.Conn, header StreamHeader) {
+		defer lconn.Close()
+		if header.Mapping == "" && header.Target == "" && config.FrontEnd != "" {
+			serveFrontEnd(f, lconn)
+			return
+		}
+		upstream, err := f.openUpstream(header)
+		if err != nil {
+			return
+		}
+		relayUpstream(lconn, upstream)
+	})
+}
+func readDialStatus(upstream io.ReadWriteCloser) error {
+	if conn, ok := upstream.(interface{ SetReadDeadline(time.Time) error }); ok {
+		conn.SetReadDeadline(time.Now().Add(dialStatusTimeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	var status [1]byte
+	if _, err := io.ReadFull(upstream, status[:]); err != nil {
+		return err
+	}
+	switch status[0] {
+	case dialOk:
+		return nil
+	case dialDenied:
+		return errTargetDenied
+	}
+	return errTargetUnreachable
+}
+func relayUpstream(lconn net.Conn, upstream io.ReadWriteCloser) {
+	defer upstream.Close()
+	go relayConnections(upstream, lconn)
+	relayConnections(lconn, upstream)
+}
+func writeWsHeader(wsConn *websocket.Conn, header StreamHeader) error {
+	var frame bytes.Buffer
+	if err := writeStreamHeader(&frame, header); err != nil {
+		return err
+	}
+	return wsConn.WriteMessage(websocket.BinaryMessage, frame.Bytes())
+}
+
+type closerList struct {
+	closers []interface{ Close() error }
+}
+
+func (l *closerList) add(c interface{ Close() error }) {
+	l.closers = append(l.closers, c)
+}
+func (l *closerList) Close() error {
+	var first error
+	for _, c := range l.closers {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
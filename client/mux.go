@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+type MuxConfig struct {
+	Version           int
+	KeepAliveDisabled bool
+	KeepAliveInterval int
+	KeepAliveTimeout  int
+	MaxFrameSize      int
+	MaxReceiveBuffer  int
+	MaxStreamBuffer   int
+}
+
+var muxConfig = smux.DefaultConfig()
+
+func buildMuxConfig(muxConf MuxConfig) (*smux.Config, error) {
+	smuxConfig := smux.DefaultConfig()
+	if muxConf.Version != 0 {
+		smuxConfig.Version = muxConf.Version
+	}
+	smuxConfig.KeepAliveDisabled = muxConf.KeepAliveDisabled
+	if muxConf.KeepAliveInterval != 0 {
+		smuxConfig.KeepAliveInterval = time.Duration(muxConf.KeepAliveInterval) * time.Second
+	}
+	if muxConf.KeepAliveTimeout != 0 {
+		smuxConfig.KeepAliveTimeout = time.Duration(muxConf.KeepAliveTimeout) * time.Second
+	}
+	if muxConf.MaxFrameSize != 0 {
+		smuxConfig.MaxFrameSize = muxConf.MaxFrameSize
+	}
+	if muxConf.MaxReceiveBuffer != 0 {
+		smuxConfig.MaxReceiveBuffer = muxConf.MaxReceiveBuffer
+	}
+	if muxConf.MaxStreamBuffer != 0 {
+		smuxConfig.MaxStreamBuffer = muxConf.MaxStreamBuffer
+	}
+	if err := smux.VerifyConfig(smuxConfig); err != nil {
+		return nil, err
+	}
+	return smuxConfig, nil
+}
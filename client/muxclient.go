@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+const muxRedialMin = 500 * time.Millisecond
+const muxRedialMax = 30 * time.Second
+const muxRedialWait = 10 * time.Second
+
+var errMuxClosed = errors.New("mux forwarder stopped")
+
+type muxClient struct {
+	f       *forwarder
+	index   int
+	redials int64
+	dial    func(dataPort string) (io.ReadWriteCloser, error)
+	mu      sync.Mutex
+	session *smux.Session
+	token   string
+	ready   chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+type muxStream struct {
+	*smux.Stream
+	client  *muxClient
+	session *smux.Session
+}
+
+type muxPool struct {
+	clients []*muxClient
+	balance string
+	next    uint32
+}
+
+func newMuxClient(f *forwarder, index int, dial func(dataPort string) (io.ReadWriteCloser, error), required bool) (*muxClient, error) {
+	m := &muxClient{f: f, index: index, dial: dial, ready: make(chan struct{}), done: make(chan struct{})}
+	session, token, err := m.connect()
+	if err != nil {
+		if required {
+			return nil, err
+		}
+		log(fmt.Sprintf("WARN: %s mux session #%d to port %s failed, will keep redialing: %v", f.Protocol, index, f.Port, err))
+	} else {
+		m.session = session
+		m.token = token
+		close(m.ready)
+	}
+	go m.maintain()
+	return m, nil
+}
+func (m *muxClient) connect() (*smux.Session, string, error) {
+	baseConn, err := m.dial(m.f.Port)
+	if err != nil {
+		return nil, "", err
+	}
+	session, err := smux.Client(baseConn, muxConfig)
+	if err != nil {
+		baseConn.Close()
+		return nil, "", err
+	}
+	token := ""
+	if len(config.ReverseMappings) > 0 {
+		token = getSessionToken()
+		if err := bindReverse(session, token); err != nil {
+			session.Close()
+			return nil, "", err
+		}
+		go serveReverseStreams(session)
+	}
+	return session, token, nil
+}
+func (m *muxClient) current() (*smux.Session, chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.session, m.ready
+}
+func (m *muxClient) markDead(session *smux.Session) {
+	m.mu.Lock()
+	if m.session == session {
+		m.session = nil
+		m.ready = make(chan struct{})
+	}
+	m.mu.Unlock()
+	session.Close()
+}
+func (m *muxClient) redialIfUnbound(token string) {
+	m.mu.Lock()
+	session, bound := m.session, m.token
+	m.mu.Unlock()
+	if session == nil || session.IsClosed() || bound == token {
+		return
+	}
+	log(fmt.Sprintf("INFO: Control session changed, redialing %s mux session #%d to bind reverse mappings.", m.f.Protocol, m.index))
+	m.markDead(session)
+}
+func (m *muxClient) maintain() {
+	for {
+		session, _ := m.current()
+		if session != nil {
+			select {
+			case <-session.CloseChan():
+			case <-m.done:
+				return
+			}
+			select {
+			case <-m.done:
+				return
+			default:
+			}
+			log(fmt.Sprintf("WARN: %s mux session #%d to port %s closed, redialing.", m.f.Protocol, m.index, m.f.Port))
+			m.markDead(session)
+		}
+		backoff := muxRedialMin
+		for {
+			wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			select {
+			case <-time.After(wait):
+			case <-m.done:
+				return
+			}
+			fresh, token, err := m.connect()
+			if err == nil {
+				m.mu.Lock()
+				select {
+				case <-m.done:
+					m.mu.Unlock()
+					fresh.Close()
+					return
+				default:
+				}
+				m.session = fresh
+				m.token = token
+				close(m.ready)
+				m.mu.Unlock()
+				redials := atomic.AddInt64(&m.redials, 1)
+				log(fmt.Sprintf("INFO: %s mux session #%d to port %s re-established (%d redials).", m.f.Protocol, m.index, m.f.Port, redials))
+				if len(config.ReverseMappings) > 0 {
+					// The control session may have been replaced while this one was binding.
+					m.redialIfUnbound(getSessionToken())
+				}
+				break
+			}
+			backoff *= 2
+			if backoff > muxRedialMax {
+				backoff = muxRedialMax
+			}
+			log(fmt.Sprintf("WARN: %s mux session #%d redial to port %s failed: %v", m.f.Protocol, m.index, m.f.Port, err))
+		}
+	}
+}
+func (m *muxClient) healthySession() *smux.Session {
+	session, _ := m.current()
+	if session == nil || session.IsClosed() {
+		return nil
+	}
+	return session
+}
+func (m *muxClient) get() (*smux.Session, error) {
+	timeout := time.NewTimer(muxRedialWait)
+	defer timeout.Stop()
+	for {
+		session, ready := m.current()
+		if session != nil {
+			if !session.IsClosed() {
+				return session, nil
+			}
+			m.markDead(session)
+			continue
+		}
+		select {
+		case <-ready:
+		case <-m.done:
+			return nil, errMuxClosed
+		case <-timeout.C:
+			return nil, fmt.Errorf("no %s mux session to port %s after %s", m.f.Protocol, m.f.Port, muxRedialWait)
+		}
+	}
+}
+func (m *muxClient) openStream() (*muxStream, error) {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var session *smux.Session
+		if session, err = m.get(); err != nil {
+			return nil, err
+		}
+		var stream *smux.Stream
+		if stream, err = session.OpenStream(); err == nil {
+			return &muxStream{Stream: stream, client: m, session: session}, nil
+		}
+		m.markDead(session)
+	}
+	return nil, err
+}
+func (s *muxStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	if err != nil && err != io.ErrClosedPipe {
+		// ErrClosedPipe only means this stream was closed, any other error comes from the session's connection.
+		s.client.markDead(s.session)
+	}
+	return n, err
+}
+func (m *muxClient) Close() error {
+	m.once.Do(func() {
+		m.mu.Lock()
+		close(m.done)
+		session := m.session
+		m.mu.Unlock()
+		if session != nil {
+			go drainMuxSession(session)
+		}
+	})
+	return nil
+}
+func muxBalance() (string, error) {
+	switch balance := strings.ToLower(config.MuxBalance); balance {
+	case "", "least-streams":
+		return "least-streams", nil
+	case "round-robin":
+		return balance, nil
+	}
+	return "", fmt.Errorf("unknown MuxBalance '%s' (use least-streams or round-robin)", config.MuxBalance)
+}
+func newMuxPool(f *forwarder, dial func(dataPort string) (io.ReadWriteCloser, error)) (*muxPool, error) {
+	size := config.MuxConnections
+	if size < 1 {
+		size = 1
+	}
+	balance, err := muxBalance()
+	if err != nil {
+		return nil, err
+	}
+	p := &muxPool{balance: balance}
+	for i := 0; i < size; i++ {
+		client, err := newMuxClient(f, i, dial, i == 0)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.clients = append(p.clients, client)
+	}
+	if size > 1 {
+		log(fmt.Sprintf("INFO: %s forwarder uses %d mux sessions (%s).", f.Protocol, size, balance))
+	}
+	return p, nil
+}
+func (p *muxPool) pick() *muxClient {
+	if len(p.clients) == 1 {
+		return p.clients[0]
+	}
+	if p.balance == "round-robin" {
+		start := int(atomic.AddUint32(&p.next, 1))
+		for i := range p.clients {
+			client := p.clients[(start+i)%len(p.clients)]
+			if client.healthySession() != nil {
+				return client
+			}
+		}
+		return p.clients[start%len(p.clients)]
+	}
+	var best *muxClient
+	bestStreams := 0
+	for _, client := range p.clients {
+		session := client.healthySession()
+		if session == nil {
+			continue
+		}
+		if streams := session.NumStreams(); best == nil || streams < bestStreams {
+			best, bestStreams = client, streams
+		}
+	}
+	if best == nil {
+		return p.clients[0]
+	}
+	return best
+}
+func (p *muxPool) openStream() (*muxStream, error) {
+	return p.pick().openStream()
+}
+func (p *muxPool) Close() error {
+	for _, client := range p.clients {
+		client.Close()
+	}
+	return nil
+}
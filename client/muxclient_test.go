@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/xtaci/smux"
+)
+
+func testMuxClient(t *testing.T, streams int, closed bool) *muxClient {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	server, err := smux.Server(serverConn, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := server.AcceptStream(); err != nil {
+				return
+			}
+		}
+	}()
+	session, err := smux.Client(clientConn, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		session.Close()
+		server.Close()
+	})
+	for i := 0; i < streams; i++ {
+		if _, err := session.OpenStream(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if closed {
+		session.Close()
+	}
+	return &muxClient{session: session, ready: make(chan struct{})}
+}
+func TestMuxPoolPick(t *testing.T) {
+	busy, idle, dead := testMuxClient(t, 3, false), testMuxClient(t, 1, false), testMuxClient(t, 0, true)
+	missing := &muxClient{ready: make(chan struct{})}
+	pool := &muxPool{clients: []*muxClient{busy, dead, idle, missing}, balance: "least-streams"}
+	if got := pool.pick(); got != idle {
+		t.Fatal("least-streams should pick the healthy session with the fewest streams")
+	}
+	pool.clients = []*muxClient{dead, missing}
+	if got := pool.pick(); got != dead {
+		t.Fatal("least-streams should fall back to the first session when none is healthy")
+	}
+	pool = &muxPool{clients: []*muxClient{busy, dead, idle, missing}, balance: "round-robin"}
+	picked := map[*muxClient]int{}
+	for i := 0; i < 8; i++ {
+		picked[pool.pick()]++
+	}
+	if picked[dead] != 0 || picked[missing] != 0 {
+		t.Fatalf("round-robin picked an unhealthy session: %v", picked)
+	}
+	if picked[busy] == 0 || picked[idle] == 0 {
+		t.Fatalf("round-robin did not rotate over the healthy sessions: %v", picked)
+	}
+	pool = &muxPool{clients: []*muxClient{missing}, balance: "round-robin"}
+	if got := pool.pick(); got != missing {
+		t.Fatal("a pool of one should always pick its only session")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xtaci/smux"
+)
+
+const probeTimeout = 5 * time.Second
+
+func probeWs(dialer *websocket.Dialer, scheme, dataPort, path string) error {
+	probeDialer := *dialer
+	probeDialer.HandshakeTimeout = probeTimeout
+	ws, _, err := probeDialer.Dial(wsDataURL(scheme, dataPort, path), nil)
+	if err != nil {
+		return err
+	}
+	return ws.Close()
+}
+func probeKcp(transport TransportPayload) error {
+	kcpConf, err := adoptKcpParams(transport.Kcp)
+	if err != nil {
+		return err
+	}
+	conn, err := dialKcp(transport.Port, kcpConf)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	smuxConfig := *muxConfig
+	smuxConfig.KeepAliveDisabled = false
+	smuxConfig.KeepAliveInterval = 200 * time.Millisecond
+	smuxConfig.KeepAliveTimeout = probeTimeout
+	session, err := smux.Client(conn, &smuxConfig)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	deadline := time.Now().Add(probeTimeout)
+	for time.Now().Before(deadline) {
+		if conn.GetSRTT() > 0 {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.New("no KCP acknowledgement from server")
+}
+func probeTransport(transport TransportPayload) ProbeResult {
+	result := ProbeResult{Protocol: transport.Protocol, Port: transport.Port}
+	started := time.Now()
+	var err error
+	switch transport.Protocol {
+	case "tcp", "tcpmux":
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", remoteDataAddress(transport.Port), probeTimeout)
+		if err == nil {
+			conn.Close()
+		}
+	case "ws":
+		err = probeWs(websocket.DefaultDialer, "ws", transport.Port, "/ws")
+	case "wsmux":
+		err = probeWs(websocket.DefaultDialer, "ws", transport.Port, "/wsmux")
+	case "wss":
+		err = probeWs(tlsWsDialer(), "wss", transport.Port, "/wss")
+	case "wssmux":
+		err = probeWs(tlsWsDialer(), "wss", transport.Port, "/wssmux")
+	case "utcpmux":
+		err = probeKcp(transport)
+	case "udp":
+		result.Reachable = true
+		result.Error = "udp reachability cannot be verified"
+		return result
+	default:
+		err = fmt.Errorf("unknown protocol '%s'", transport.Protocol)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Reachable = true
+	result.RttMs = time.Since(started).Milliseconds()
+	return result
+}
+func probeTransports(transports []TransportPayload) []ProbeResult {
+	results := make([]ProbeResult, len(transports))
+	var wg sync.WaitGroup
+	for i, transport := range transports {
+		wg.Add(1)
+		go func(i int, transport TransportPayload) {
+			defer wg.Done()
+			results[i] = probeTransport(transport)
+		}(i, transport)
+	}
+	wg.Wait()
+	for _, result := range results {
+		if result.Reachable {
+			log(fmt.Sprintf("PROBE: %s:%s reachable (%dms)", result.Protocol, result.Port, result.RttMs))
+		} else {
+			log(fmt.Sprintf("PROBE: %s:%s unreachable: %s", result.Protocol, result.Port, result.Error))
+		}
+	}
+	return results
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const protocolVersion = 4
+const minProtocolVersion = 4
+const maxStreamHeaderSize = 4096
+
+const (
+	msgAuthChallenge   = "auth_challenge"
+	msgAuthResponse    = "auth_response"
+	msgAuthOk          = "auth_ok"
+	msgAuthFailed      = "auth_failed"
+	msgHello           = "hello"
+	msgStartTransport  = "start_transport"
+	msgStopTransport   = "stop_transport"
+	msgSwitchTransport = "switch_transport"
+	msgPing            = "ping"
+	msgPong            = "pong"
+	msgStats           = "stats"
+	msgProbeTransports = "probe_transports"
+	msgProbeResult     = "probe_result"
+	msgTransportFailed = "transport_failed"
+	msgAck             = "ack"
+	msgError           = "error"
+)
+
+const (
+	errIncompatibleVersion = "incompatible_version"
+	errUnknownType         = "unknown_type"
+	errBadPayload          = "bad_payload"
+	errUnexpectedMessage   = "unexpected_message"
+	errKcpCryptMismatch    = "kcp_crypt_mismatch"
+)
+const (
+	streamConnect = "connect"
+	streamBind    = "bind"
+	streamReverse = "reverse"
+	streamUdp     = "udp"
+)
+const (
+	dialOk     byte = 0x00
+	dialDenied byte = 0x01
+	dialFailed byte = 0x02
+)
+
+type Message struct {
+	Type    string          `json:"type"`
+	ID      uint64          `json:"id,omitempty"`
+	ReplyTo uint64          `json:"reply_to,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+type HelloPayload struct {
+	Version      int      `json:"version"`
+	MinVersion   int      `json:"min_version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	SessionID    string   `json:"session_id,omitempty"`
+	SessionToken string   `json:"session_token,omitempty"`
+	Resumed      bool     `json:"resumed,omitempty"`
+	KcpCrypt     string   `json:"kcp_crypt,omitempty"`
+	Reverse      []string `json:"reverse,omitempty"`
+}
+type KcpParams struct {
+	Mode         string `json:"mode"`
+	NoDelay      int    `json:"nodelay"`
+	Interval     int    `json:"interval"`
+	Resend       int    `json:"resend"`
+	NoCongestion int    `json:"nc"`
+	SndWnd       int    `json:"sndwnd"`
+	RcvWnd       int    `json:"rcvwnd"`
+	DataShards   int    `json:"datashard"`
+	ParityShards int    `json:"parityshard"`
+	Mtu          int    `json:"mtu,omitempty"`
+	AckNoDelay   bool   `json:"acknodelay,omitempty"`
+	StreamMode   bool   `json:"streammode,omitempty"`
+	WriteDelay   bool   `json:"writedelay,omitempty"`
+	Crypt        string `json:"crypt"`
+}
+type TransportPayload struct {
+	Protocol string     `json:"protocol"`
+	Port     string     `json:"port,omitempty"`
+	Kcp      *KcpParams `json:"kcp,omitempty"`
+}
+type ProbeRequestPayload struct {
+	Transports []TransportPayload `json:"transports"`
+}
+type ProbeResult struct {
+	Protocol  string `json:"protocol"`
+	Port      string `json:"port"`
+	Reachable bool   `json:"reachable"`
+	RttMs     int64  `json:"rtt_ms,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+type ProbeResultPayload struct {
+	Results []ProbeResult `json:"results"`
+}
+type TransportFailedPayload struct {
+	Protocol string `json:"protocol"`
+	Port     string `json:"port"`
+	Error    string `json:"error"`
+}
+type PingPayload struct {
+	Timestamp int64 `json:"timestamp"`
+}
+type StatsPayload struct {
+	Protocol          string `json:"protocol,omitempty"`
+	Port              string `json:"port,omitempty"`
+	UptimeSeconds     int64  `json:"uptime_seconds"`
+	ActiveConnections int64  `json:"active_connections"`
+	TotalConnections  int64  `json:"total_connections"`
+	BytesSent         int64  `json:"bytes_sent"`
+	BytesReceived     int64  `json:"bytes_received"`
+}
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newMessage(msgType string, payload interface{}) (Message, error) {
+	msg := Message{Type: msgType}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return msg, err
+		}
+		msg.Payload = data
+	}
+	return msg, nil
+}
+func decodePayload(msg Message, payload interface{}) error {
+	if len(msg.Payload) == 0 {
+		return fmt.Errorf("'%s' message has no payload", msg.Type)
+	}
+	if err := json.Unmarshal(msg.Payload, payload); err != nil {
+		return fmt.Errorf("malformed '%s' payload: %v", msg.Type, err)
+	}
+	return nil
+}
+
+type StreamHeader struct {
+	Type    string `json:"type"`
+	Token   string `json:"token,omitempty"`
+	Mapping string `json:"mapping,omitempty"`
+	Target  string `json:"target,omitempty"`
+}
+
+func (h StreamHeader) String() string {
+	if h.Target != "" {
+		return "target " + h.Target
+	}
+	if h.Mapping != "" {
+		return "mapping '" + h.Mapping + "'"
+	}
+	return "the default mapping"
+}
+
+type peerError struct {
+	ErrorPayload
+}
+
+func (e *peerError) Error() string {
+	return fmt.Sprintf("peer error %s: %s", e.Code, e.Message)
+}
+func readMessage(reader *json.Decoder, msgType string, payload interface{}) error {
+	var msg Message
+	if err := reader.Decode(&msg); err != nil {
+		return err
+	}
+	if msg.Type == msgError {
+		var e ErrorPayload
+		decodePayload(msg, &e)
+		return &peerError{e}
+	}
+	if msg.Type != msgType {
+		return fmt.Errorf("expected '%s', got '%s'", msgType, msg.Type)
+	}
+	if payload == nil {
+		return nil
+	}
+	return decodePayload(msg, payload)
+}
+func writeMessage(writer *json.Encoder, msgType string, payload interface{}) error {
+	msg, err := newMessage(msgType, payload)
+	if err != nil {
+		return err
+	}
+	return writer.Encode(msg)
+}
+func negotiateVersion(hello HelloPayload) (int, error) {
+	version := hello.Version
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+	if version < minProtocolVersion || version < hello.MinVersion {
+		return 0, fmt.Errorf("peer speaks versions %d-%d, we speak %d-%d", hello.MinVersion, hello.Version, minProtocolVersion, protocolVersion)
+	}
+	return version, nil
+}
+func hasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+func writeStreamHeader(w io.Writer, header StreamHeader) error {
+	body, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 2+len(body))
+	binary.BigEndian.PutUint16(frame, uint16(len(body)))
+	copy(frame[2:], body)
+	_, err = w.Write(frame)
+	return err
+}
+func readStreamHeader(r io.Reader) (StreamHeader, error) {
+	var header StreamHeader
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return header, err
+	}
+	length := binary.BigEndian.Uint16(size[:])
+	if length == 0 || length > maxStreamHeaderSize {
+		return header, fmt.Errorf("invalid stream header length %d", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return header, err
+	}
+	if err := json.Unmarshal(body, &header); err != nil {
+		return header, err
+	}
+	return header, nil
+}
+func writeDatagram(w io.Writer, addr string, payload []byte) error {
+	if len(addr) > 255 || len(payload) > 65535 {
+		return fmt.Errorf("datagram for %s too large", addr)
+	}
+	frame := make([]byte, 1+len(addr)+2+len(payload))
+	frame[0] = byte(len(addr))
+	copy(frame[1:], addr)
+	binary.BigEndian.PutUint16(frame[1+len(addr):], uint16(len(payload)))
+	copy(frame[3+len(addr):], payload)
+	_, err := w.Write(frame)
+	return err
+}
+func readDatagram(r io.Reader) (string, []byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:1]); err != nil {
+		return "", nil, err
+	}
+	addr := make([]byte, size[0])
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", nil, err
+	}
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return "", nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, err
+	}
+	return string(addr), payload, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+type ReverseTarget struct {
+	Name   string
+	Target string
+}
+
+const streamHeaderTimeout = 10 * time.Second
+const reverseDialTimeout = 10 * time.Second
+
+func reverseMappingNames() []string {
+	var names []string
+	for _, mapping := range config.ReverseMappings {
+		names = append(names, mapping.Name)
+	}
+	return names
+}
+func reverseTarget(name string) (string, bool) {
+	for _, mapping := range config.ReverseMappings {
+		if mapping.Name == name {
+			return mapping.Target, true
+		}
+	}
+	return "", false
+}
+func bindReverse(session *smux.Session, token string) error {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	return writeStreamHeader(stream, StreamHeader{Type: streamBind, Token: token})
+}
+func rebindReverse() {
+	if len(config.ReverseMappings) == 0 {
+		return
+	}
+	forwarderMu.Lock()
+	f := currentForwarder
+	forwarderMu.Unlock()
+	if f == nil || f.mux == nil {
+		return
+	}
+	token := getSessionToken()
+	for _, client := range f.mux.clients {
+		client.redialIfUnbound(token)
+	}
+}
+func serveReverseStreams(session *smux.Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go handleReverseStream(stream)
+	}
+}
+func handleReverseStream(stream *smux.Stream) {
+	defer stream.Close()
+	stream.SetReadDeadline(time.Now().Add(streamHeaderTimeout))
+	header, err := readStreamHeader(stream)
+	stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+	if header.Type != streamReverse {
+		log(fmt.Sprintf("WARN: Unexpected mux stream type '%s' from server.", header.Type))
+		return
+	}
+	target, ok := reverseTarget(header.Mapping)
+	if !ok {
+		log(fmt.Sprintf("WARN: Server requested unknown reverse mapping '%s'.", header.Mapping))
+		return
+	}
+	conn, err := net.DialTimeout("tcp", target, reverseDialTimeout)
+	if err != nil {
+		log(fmt.Sprintf("WARN: Reverse mapping '%s' could not reach %s: %v", header.Mapping, target, err))
+		return
+	}
+	defer conn.Close()
+	go relayConnections(conn, stream)
+	relayConnections(stream, conn)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+var tlsClientConfig *tls.Config
+
+func parsePin(pin string) ([]byte, error) {
+	cleaned := strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(pin))
+	digest, err := hex.DecodeString(cleaned)
+	if err != nil || len(digest) != sha256.Size {
+		return nil, fmt.Errorf("TlsPinSHA256 must be a hex SHA-256 digest, got '%s'", pin)
+	}
+	return digest, nil
+}
+func spkiFingerprint(cert *x509.Certificate) []byte {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return digest[:]
+}
+func loadClientTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: config.TlsServerName}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = config.RemoteServerIP
+	}
+	if config.TlsClientCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(config.TlsClientCertPath, config.TlsClientKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.TlsInsecureSkipVerify {
+		log("WARN: TlsInsecureSkipVerify is enabled, the server certificate will not be verified.")
+		tlsConfig.InsecureSkipVerify = true
+		return tlsConfig, nil
+	}
+	if config.TlsCAPath != "" {
+		pem, err := os.ReadFile(config.TlsCAPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.TlsCAPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.TlsPinSHA256 != "" {
+		pin, err := parsePin(config.TlsPinSHA256)
+		if err != nil {
+			return nil, err
+		}
+		if config.TlsCAPath == "" {
+			// The pin replaces chain validation, which is what makes self-signed certificates usable.
+			tlsConfig.InsecureSkipVerify = true
+		}
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			if !bytes.Equal(spkiFingerprint(cs.PeerCertificates[0]), pin) {
+				return fmt.Errorf("server certificate does not match TlsPinSHA256 (got %s)", hex.EncodeToString(spkiFingerprint(cs.PeerCertificates[0])))
+			}
+			return nil
+		}
+	}
+	return tlsConfig, nil
+}
+func tlsWsDialer() *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsClientConfig.Clone()
+	return &dialer
+}
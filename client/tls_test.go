@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "g-tun test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"tunnel.example"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+func TestParsePin(t *testing.T) {
+	digest := strings.Repeat("ab", 32)
+	tests := []struct {
+		name    string
+		pin     string
+		wantErr bool
+	}{
+		{"plain hex", digest, false},
+		{"upper case with colons", strings.ToUpper(strings.Repeat("ab:", 31) + "ab"), false},
+		{"spaces", strings.Repeat("ab ", 32), false},
+		{"too short", digest[:62], true},
+		{"not hex", strings.Repeat("zz", 32), true},
+		{"empty", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePin(tt.pin)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePin() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && hex.EncodeToString(got) != digest {
+				t.Fatalf("parsePin() = %x, want %s", got, digest)
+			}
+		})
+	}
+}
+func TestPinnedVerifyConnection(t *testing.T) {
+	serverCert, leaf := testCertificate(t)
+	_, otherLeaf := testCertificate(t)
+	saved := config
+	defer func() { config = saved }()
+	config = ClientConfig{RemoteServerIP: "192.0.2.1", TlsServerName: "tunnel.example", TlsPinSHA256: hex.EncodeToString(spkiFingerprint(leaf))}
+	tlsConfig, err := loadClientTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tlsConfig.InsecureSkipVerify || tlsConfig.VerifyConnection == nil {
+		t.Fatal("a pin without TlsCAPath should replace chain validation with VerifyConnection")
+	}
+	tests := []struct {
+		name    string
+		certs   []*x509.Certificate
+		wantErr bool
+	}{
+		{"pinned certificate", []*x509.Certificate{leaf}, false},
+		{"other certificate", []*x509.Certificate{otherLeaf}, true},
+		{"no certificate", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tlsConfig.VerifyConnection(tls.ConnectionState{PeerCertificates: tt.certs})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyConnection() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{serverCert}}).Handshake()
+	}()
+	if err := tls.Client(clientConn, tlsConfig).Handshake(); err != nil {
+		t.Fatalf("handshake with the pinned certificate failed: %v", err)
+	}
+}
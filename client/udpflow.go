@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultUdpIdleTimeout = 60
+
+type udpFlow struct {
+	upstream io.ReadWriteCloser
+	idle     *time.Timer
+}
+
+func udpIdleTimeout() time.Duration {
+	timeout := config.UdpIdleTimeout
+	if timeout <= 0 {
+		timeout = defaultUdpIdleTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+func listenUdpMappings(f *forwarder) (*closerList, error) {
+	listeners := &closerList{}
+	for _, endpoint := range mappingEndpoints(streamUdp) {
+		localAddr, err := net.ResolveUDPAddr("udp", endpoint.address)
+		if err != nil {
+			listeners.Close()
+			return nil, err
+		}
+		localConn, err := net.ListenUDP("udp", localAddr)
+		if err != nil {
+			listeners.Close()
+			return nil, err
+		}
+		listeners.add(localConn)
+		go serveUdpFlows(f, localConn, endpoint.header)
+	}
+	return listeners, nil
+}
+func serveUdpFlows(f *forwarder, localConn *net.UDPConn, header StreamHeader) {
+	defer localConn.Close()
+	flows := make(map[string]*udpFlow)
+	var mu sync.Mutex
+	timeout := udpIdleTimeout()
+	buf := make([]byte, 65535)
+	for {
+		n, clientAddr, err := localConn.ReadFromUDP(buf)
+		if err != nil {
+			mu.Lock()
+			for _, flow := range flows {
+				flow.upstream.Close()
+			}
+			mu.Unlock()
+			return
+		}
+		mu.Lock()
+		flow, ok := flows[clientAddr.String()]
+		mu.Unlock()
+		if !ok {
+			upstream, err := f.openUpstream(header)
+			if err != nil {
+				continue
+			}
+			flow = &udpFlow{upstream: upstream, idle: time.AfterFunc(timeout, func() { upstream.Close() })}
+			mu.Lock()
+			flows[clientAddr.String()] = flow
+			mu.Unlock()
+			atomic.AddInt64(&forwarderStats.ActiveConnections, 1)
+			atomic.AddInt64(&forwarderStats.TotalConnections, 1)
+			go func(flow *udpFlow, cAddr *net.UDPAddr) {
+				defer atomic.AddInt64(&forwarderStats.ActiveConnections, -1)
+				for {
+					_, payload, err := readDatagram(flow.upstream)
+					if err != nil {
+						mu.Lock()
+						delete(flows, cAddr.String())
+						mu.Unlock()
+						flow.idle.Stop()
+						flow.upstream.Close()
+						return
+					}
+					flow.idle.Reset(timeout)
+					localConn.WriteToUDP(payload, cAddr)
+					atomic.AddInt64(&forwarderStats.BytesReceived, int64(len(payload)))
+				}
+			}(flow, clientAddr)
+		}
+		flow.idle.Reset(timeout)
+		// An empty address sends the datagram to the stream's own mapping or target.
+		if err := writeDatagram(flow.upstream, "", buf[:n]); err != nil {
+			log(fmt.Sprintf("WARN: UDP flow from %s to %s failed: %v", clientAddr.String(), header, err))
+			flow.upstream.Close()
+			continue
+		}
+		atomic.AddInt64(&forwarderStats.BytesSent, int64(n))
+	}
+}
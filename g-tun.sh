@@ -9,7 +9,6 @@
 INSTALL_DIR="/usr/local/g-tun"
 GO_BIN="/usr/local/go/bin/go"
 SERVICE_NAME="g-tun"
-SCREEN_NAME="g-tun_console"
 
 # --- Colors ---
 RED='\033[0;31m'
@@ -72,12 +71,6 @@ install_deps() {
         export PATH=$PATH:/usr/local/go/bin
     fi
 
-    # Generate TLS Certs if missing
-    if [ ! -f "$INSTALL_DIR/server/cert.pem" ]; then
-        echo -e "${YELLOW}[G-Tun] Generating TLS Certificates...${NC}"
-        cd "$INSTALL_DIR/server" && "$GO_BIN" run generate_cert.go
-    fi
-
     echo -e "${YELLOW}[G-Tun] Fixing Go Modules...${NC}"
     export PATH=$PATH:/usr/local/go/bin
     
@@ -95,15 +88,21 @@ install_deps() {
     
     # Build Server
     cd "$INSTALL_DIR/server"
-    if "$GO_BIN" build -o g-tun-server server.go; then
+    if "$GO_BIN" build -o g-tun-server .; then
         echo -e "${GREEN}✔ Server Built Successfully${NC}"
     else
         echo -e "${RED}✘ Server Build Failed!${NC}"; exit 1
     fi
 
+    # Generate TLS Certs if missing
+    if [ ! -f "$INSTALL_DIR/server/cert.pem" ]; then
+        echo -e "${YELLOW}[G-Tun] Generating TLS Certificates...${NC}"
+        ./g-tun-server cert server || { echo -e "${RED}✘ Certificate Generation Failed!${NC}"; exit 1; }
+    fi
+
     # Build Client
     cd "$INSTALL_DIR/client"
-    if "$GO_BIN" build -o g-tun-client client.go; then
+    if "$GO_BIN" build -o g-tun-client .; then
         echo -e "${GREEN}✔ Client Built Successfully${NC}"
     else
         echo -e "${RED}✘ Client Build Failed!${NC}"; exit 1
@@ -120,10 +119,10 @@ create_service() {
 
     if [ "$role" == "client" ]; then
         work_dir="$INSTALL_DIR/client"
-        exec_cmd="./g-tun-client"
+        exec_cmd="g-tun-client"
     else
         work_dir="$INSTALL_DIR/server"
-        exec_cmd="./g-tun-server"
+        exec_cmd="g-tun-server"
     fi
 
     if [ ! -f "$work_dir/g-tun-$role" ]; then
@@ -133,7 +132,6 @@ create_service() {
 
     echo -e "${YELLOW}[G-Tun] Creating Service for $role...${NC}"
 
-    # Use 'sleep 10' to keep screen open on crash for debugging
     cat <<EOF > /etc/systemd/system/$SERVICE_NAME.service
 [Unit]
 Description=G-Tun Service ($role)
@@ -143,8 +141,7 @@ After=network.target
 Type=simple
 User=root
 WorkingDirectory=$work_dir
-ExecStart=/usr/bin/screen -DmS $SCREEN_NAME /bin/bash -c "$exec_cmd || sleep 10"
-ExecStop=/usr/bin/screen -S $SCREEN_NAME -X quit
+ExecStart=$work_dir/$exec_cmd
 Restart=always
 RestartSec=3s
 
@@ -168,13 +165,23 @@ configure() {
         read -p "Foreign IP: " ip
         read -p "Foreign Control Port [8880]: " cport; cport=${cport:-8880}
         read -p "Local Proxy Port [2054]: " lport; lport=${lport:-2054}
+        read -p "Auth Key (shown on the server after configuration): " authkey
+        read -p "Server TLS Pin (shown on the server, empty = skip verification): " tlspin
+        if [ -n "$tlspin" ]; then
+            tls_json="\"TlsPinSHA256\": \"$tlspin\""
+        else
+            echo -e "${RED}Warning: WSS/WSSMux server certificate will not be verified.${NC}"
+            tls_json="\"TlsInsecureSkipVerify\": true"
+        fi
 
         cat <<EOF > "$INSTALL_DIR/client/client_config.json"
 {
     "ControlServerAddress": "$ip:$cport",
     "LocalListenPort": "0.0.0.0:$lport",
     "RemoteServerIP": "$ip",
-    "KcpConfig": { "NoDelay": 1, "Interval": 10, "Resend": 2, "NoCongestion": 1, "SndWnd": 1024, "RcvWnd": 1024, "DataShards": 10, "ParityShards": 3 }
+    "AuthKey": "$authkey",
+    $tls_json,
+    "KcpConfig": { "Mode": "fast3", "SndWnd": 1024, "RcvWnd": 1024, "DataShards": 10, "ParityShards": 3, "Crypt": "aes" }
 }
 EOF
         create_service "client"
@@ -183,6 +190,11 @@ EOF
         # SERVER
         read -p "Listen Control Port [8880]: " cport; cport=${cport:-8880}
         read -p "Target Xray Address [127.0.0.1:1080]: " target; target=${target:-127.0.0.1:1080}
+        echo "Transports: tcp, udp, ws, tcpmux, wsmux, wss, wssmux, utcpmux"
+        read -p "Transport [tcpmux]: " transport; transport=${transport:-tcpmux}
+        read -p "Fallback Transports (space separated) [tcp]: " fallbacks; fallbacks=${fallbacks:-tcp}
+        fallback_json=$(printf '"%s", ' $fallbacks); fallback_json="[${fallback_json%, }]"
+        authkey=$(head -c 32 /dev/urandom | od -An -tx1 | tr -d ' \n')
 
         echo -e "${YELLOW}Clearing port $cport...${NC}"
         fuser -k -n tcp $cport 2> /dev/null
@@ -193,29 +205,27 @@ EOF
     "DataPorts": { "TCP": "9091", "UDP": "9092", "WS": "9093", "TCPMux": "9094", "WSMux": "9095", "WSS": "9096", "WSSMux": "9097", "UTCPMux": "9098" },
     "XrayInboundAddress": "$target",
     "TlsCertPath": "cert.pem", "TlsKeyPath": "key.pem",
-    "KcpConfig": { "NoDelay": 1, "Interval": 10, "Resend": 2, "NoCongestion": 1, "SndWnd": 1024, "RcvWnd": 1024, "DataShards": 10, "ParityShards": 3 }
+    "Transport": "$transport",
+    "FallbackTransports": $fallback_json,
+    "AuthKey": "$authkey",
+    "KcpConfig": { "Mode": "fast3", "SndWnd": 1024, "RcvWnd": 1024, "DataShards": 10, "ParityShards": 3, "Crypt": "aes" }
 }
 EOF
         create_service "server"
+        echo -e "${YELLOW}Auth Key (enter this on the client): ${GREEN}$authkey${NC}"
+        if [ -f "$INSTALL_DIR/server/cert.pem" ]; then
+            tlspin=$("$INSTALL_DIR/server/g-tun-server" cert fingerprint "$INSTALL_DIR/server/cert.pem")
+            echo -e "${YELLOW}TLS Pin (enter this on the client): ${GREEN}$tlspin${NC}"
+        fi
     fi
     echo -e "${GREEN}✔ Config Saved.${NC}"
 }
 
-enter_console() {
-    echo -e "${YELLOW}Connecting to G-Tun Console...${NC}"
-    sleep 2
-    
-    if screen -list | grep -q "$SCREEN_NAME"; then
-        echo -e "${CYAN}-------------------------------------------------------${NC}"
-        echo -e " >> Wait for 'Client Connected' -> Select Protocol"
-        echo -e " >> To EXIT keeping tunnel alive: Press ${GREEN}Ctrl+A${NC} then ${GREEN}D${NC}"
-        echo -e "${CYAN}-------------------------------------------------------${NC}"
-        read -p "Press Enter..."
-        screen -r $SCREEN_NAME
-    else
-        echo -e "${RED}Error: Service not running or crashed.${NC}"
-        journalctl -u $SERVICE_NAME -n 10 --no-pager
-    fi
+show_logs() {
+    echo -e "${CYAN}-------------------------------------------------------${NC}"
+    echo -e " >> To EXIT keeping tunnel alive: Press ${GREEN}Ctrl+C${NC}"
+    echo -e "${CYAN}-------------------------------------------------------${NC}"
+    journalctl -u $SERVICE_NAME -n 20 -f
 }
 
 start_tunnel() {
@@ -223,20 +233,11 @@ start_tunnel() {
     killall -9 g-tun-server g-tun-client 2>/dev/null
     systemctl start $SERVICE_NAME
     echo -e "${GREEN}✔ Service Started.${NC}"
-    
-    # Auto-Console for Server
-    if [ -f "$INSTALL_DIR/server/server_config.json" ]; then
-        if grep -q "ControlPort" "$INSTALL_DIR/server/server_config.json"; then
-             enter_console
-        else
-             echo -e "${BLUE}Client running in background.${NC}"
-        fi
-    fi
+    show_logs
 }
 
 stop_tunnel() {
     systemctl stop $SERVICE_NAME
-    screen -S $SCREEN_NAME -X quit 2>/dev/null
     echo -e "${RED}Tunnel Stopped.${NC}"
 }
 
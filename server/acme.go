@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type AcmeConfig struct {
+	Domains      []string
+	Email        string
+	CacheDir     string
+	DirectoryURL string
+	Challenge    string
+	HttpPort     string
+	CARootPath   string
+}
+
+var acmeManager *autocert.Manager
+var acmeOnce sync.Once
+var acmeErr error
+
+func acmeEnabled() bool {
+	return len(config.Acme.Domains) > 0
+}
+func validateAcmeConfig() error {
+	if !acmeEnabled() || config.ClientCAPath == "" {
+		return nil
+	}
+	switch strings.ToLower(config.Acme.Challenge) {
+	case "", "tls-alpn-01":
+		// The CA's acme-tls/1 validator sends no client certificate, so mTLS would fail every issuance.
+		return errors.New("ClientCAPath cannot be combined with the tls-alpn-01 challenge, set Acme.Challenge to http-01")
+	}
+	return nil
+}
+func newAcmeManager() (*autocert.Manager, error) {
+	acmeConf := config.Acme
+	cacheDir := acmeConf.CacheDir
+	if cacheDir == "" {
+		cacheDir = "acme-cache"
+	}
+	client := &acme.Client{DirectoryURL: acmeConf.DirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	if acmeConf.CARootPath != "" {
+		pem, err := os.ReadFile(acmeConf.CARootPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", acmeConf.CARootPath)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(acmeConf.Domains...),
+		Email:      acmeConf.Email,
+		Client:     client,
+	}
+	switch strings.ToLower(acmeConf.Challenge) {
+	case "", "tls-alpn-01":
+		log(fmt.Sprintf("INFO: ACME enabled for %s via TLS-ALPN-01 at %s, the WSS listener must be reachable on port 443.", strings.Join(acmeConf.Domains, ", "), client.DirectoryURL))
+	case "http-01":
+		port := acmeConf.HttpPort
+		if port == "" {
+			port = "80"
+		}
+		server := &http.Server{Addr: "0.0.0.0:" + port, Handler: manager.HTTPHandler(nil), ErrorLog: httpErrorLog()}
+		addListener(server)
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log(fmt.Sprintf("ERROR: ACME HTTP-01 listener on %s failed: %v", port, err))
+			}
+		}()
+		log(fmt.Sprintf("INFO: ACME enabled for %s via HTTP-01 on port %s at %s.", strings.Join(acmeConf.Domains, ", "), port, client.DirectoryURL))
+	default:
+		return nil, fmt.Errorf("unknown ACME challenge %q (use http-01 or tls-alpn-01)", acmeConf.Challenge)
+	}
+	return manager, nil
+}
+func acmeTLSConfig() (*tls.Config, error) {
+	acmeOnce.Do(func() {
+		acmeManager, acmeErr = newAcmeManager()
+	})
+	if acmeErr != nil {
+		return nil, acmeErr
+	}
+	defaultName := config.Acme.Domains[0]
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// Clients dialing by IP send no SNI, so serve them the primary domain.
+			if hello.ServerName == "" {
+				hello.ServerName = defaultName
+			}
+			return acmeManager.GetCertificate(hello)
+		},
+		NextProtos: []string{"http/1.1", acme.ALPNProto},
+	}, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TargetAllowlist struct {
+	CIDRs []string
+	Ports []string
+	Hosts []string
+}
+type allowlist struct {
+	nets  []*net.IPNet
+	ports [][2]int
+	hosts []string
+}
+
+const dynamicDialTimeout = 10 * time.Second
+
+var targetAllowlist = &allowlist{}
+var errTargetDenied = errors.New("target not allowed")
+
+func compileAllowlist(c TargetAllowlist) (*allowlist, error) {
+	a := &allowlist{}
+	for _, cidr := range c.CIDRs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s': %v", cidr, err)
+		}
+		a.nets = append(a.nets, ipNet)
+	}
+	for _, spec := range c.Ports {
+		low, high, found := strings.Cut(spec, "-")
+		if !found {
+			high = low
+		}
+		from, err1 := strconv.Atoi(strings.TrimSpace(low))
+		to, err2 := strconv.Atoi(strings.TrimSpace(high))
+		if err1 != nil || err2 != nil || from < 1 || to > 65535 || from > to {
+			return nil, fmt.Errorf("invalid port or range '%s'", spec)
+		}
+		a.ports = append(a.ports, [2]int{from, to})
+	}
+	for _, host := range c.Hosts {
+		a.hosts = append(a.hosts, strings.ToLower(strings.TrimSuffix(host, ".")))
+	}
+	if len(a.ports) > 0 && !a.enabled() {
+		return nil, errors.New("Ports only narrows CIDRs and Hosts, set at least one of them")
+	}
+	return a, nil
+}
+func (a *allowlist) enabled() bool {
+	return len(a.nets) > 0 || len(a.hosts) > 0
+}
+func (a *allowlist) portAllowed(port int) bool {
+	if len(a.ports) == 0 {
+		return true
+	}
+	for _, r := range a.ports {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+func (a *allowlist) ipAllowed(ip net.IP) bool {
+	for _, ipNet := range a.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+func (a *allowlist) hostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range a.hosts {
+		if pattern == host {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+func dialTarget(target string) (net.Conn, error) {
+	addr, err := checkTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout("tcp", addr, dynamicDialTimeout)
+}
+func checkTarget(target string) (string, error) {
+	if !targetAllowlist.enabled() {
+		return "", fmt.Errorf("%w: dynamic targets are disabled, set TargetAllowlist in server_config.json", errTargetDenied)
+	}
+	host, portText, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 1 || port > 65535 {
+		return "", fmt.Errorf("invalid port in target '%s'", target)
+	}
+	if !targetAllowlist.portAllowed(port) {
+		return "", fmt.Errorf("%w: port %d is not in the allowlist", errTargetDenied, port)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !targetAllowlist.ipAllowed(ip) {
+			return "", fmt.Errorf("%w: %s is not in the allowlist", errTargetDenied, ip)
+		}
+		return target, nil
+	}
+	if targetAllowlist.hostAllowed(host) {
+		return target, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if !targetAllowlist.ipAllowed(ip) {
+			return "", fmt.Errorf("%w: %s resolves to %s, which is not in the allowlist", errTargetDenied, host, ip)
+		}
+	}
+	// Use the address that was checked so a second lookup cannot swap it out.
+	return net.JoinHostPort(ips[0].String(), portText), nil
+}
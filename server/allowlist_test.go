@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCompileAllowlist(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    TargetAllowlist
+		wantErr bool
+	}{
+		{"empty", TargetAllowlist{}, false},
+		{"cidr", TargetAllowlist{CIDRs: []string{"10.0.0.0/8"}}, false},
+		{"bare ipv4", TargetAllowlist{CIDRs: []string{"192.0.2.1"}}, false},
+		{"bare ipv6", TargetAllowlist{CIDRs: []string{"2001:db8::1"}}, false},
+		{"bad cidr", TargetAllowlist{CIDRs: []string{"10.0.0.0/33"}}, true},
+		{"port range", TargetAllowlist{CIDRs: []string{"10.0.0.0/8"}, Ports: []string{"80", "8000-8100"}}, false},
+		{"reversed range", TargetAllowlist{CIDRs: []string{"10.0.0.0/8"}, Ports: []string{"90-80"}}, true},
+		{"port zero", TargetAllowlist{CIDRs: []string{"10.0.0.0/8"}, Ports: []string{"0"}}, true},
+		{"port too high", TargetAllowlist{Hosts: []string{"example.com"}, Ports: []string{"65536"}}, true},
+		{"ports only", TargetAllowlist{Ports: []string{"443"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileAllowlist(tt.conf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("compileAllowlist() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+func TestDialTargetRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    TargetAllowlist
+		target  string
+		wantErr string
+	}{
+		{"disabled", TargetAllowlist{}, "10.0.0.1:80", "disabled"},
+		{"ip outside cidr", TargetAllowlist{CIDRs: []string{"10.0.0.0/8"}}, "192.0.2.1:80", "not in the allowlist"},
+		{"ipv6 outside cidr", TargetAllowlist{CIDRs: []string{"2001:db8::/32"}}, "[2001:db9::5]:443", "not in the allowlist"},
+		{"port outside range", TargetAllowlist{CIDRs: []string{"10.0.0.0/8"}, Ports: []string{"8000-8100"}}, "10.0.0.1:22", "port 22"},
+		{"invalid port", TargetAllowlist{CIDRs: []string{"10.0.0.0/8"}}, "10.0.0.1:0", "invalid port"},
+		{"missing port", TargetAllowlist{CIDRs: []string{"10.0.0.0/8"}}, "10.0.0.1", "missing port"},
+		{"resolved ip rejected", TargetAllowlist{CIDRs: []string{"10.0.0.0/8"}, Hosts: []string{"*.example.com"}}, "localhost:80", "which is not in the allowlist"},
+	}
+	defer func(saved *allowlist) { targetAllowlist = saved }(targetAllowlist)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := compileAllowlist(tt.conf)
+			if err != nil {
+				t.Fatalf("compileAllowlist() error = %v", err)
+			}
+			targetAllowlist = a
+			conn, err := dialTarget(tt.target)
+			if err == nil {
+				conn.Close()
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("dialTarget(%q) error = %v, want %q", tt.target, err, tt.wantErr)
+			}
+		})
+	}
+}
+func TestDialTargetAllowed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	tests := []struct {
+		name   string
+		conf   TargetAllowlist
+		target string
+	}{
+		{"ip in cidr", TargetAllowlist{CIDRs: []string{"127.0.0.0/8"}}, "127.0.0.1:" + port},
+		{"bare ip", TargetAllowlist{CIDRs: []string{"127.0.0.1"}, Ports: []string{port}}, "127.0.0.1:" + port},
+		{"exact host", TargetAllowlist{Hosts: []string{"localhost"}}, "localhost:" + port},
+		{"host resolved into cidr", TargetAllowlist{CIDRs: []string{"127.0.0.0/8", "::1"}}, "localhost:" + port},
+	}
+	defer func(saved *allowlist) { targetAllowlist = saved }(targetAllowlist)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := compileAllowlist(tt.conf)
+			if err != nil {
+				t.Fatalf("compileAllowlist() error = %v", err)
+			}
+			targetAllowlist = a
+			conn, err := dialTarget(tt.target)
+			if err != nil {
+				t.Fatalf("dialTarget(%q) error = %v", tt.target, err)
+			}
+			conn.Close()
+		})
+	}
+}
+func TestHostAllowed(t *testing.T) {
+	a, err := compileAllowlist(TargetAllowlist{Hosts: []string{"example.com", "*.Example.net."}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.com.", true},
+		{"api.example.com", false},
+		{"api.example.net", true},
+		{"API.Example.NET.", true},
+		{"example.net", false},
+		{"badexample.net", false},
+	}
+	for _, tt := range tests {
+		if got := a.hostAllowed(tt.host); got != tt.want {
+			t.Errorf("hostAllowed(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+func TestCheckTargetResolvesToCheckedIP(t *testing.T) {
+	defer func(saved *allowlist) { targetAllowlist = saved }(targetAllowlist)
+	a, err := compileAllowlist(TargetAllowlist{CIDRs: []string{"127.0.0.0/8", "::1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetAllowlist = a
+	got, err := checkTarget("localhost:80")
+	if err != nil {
+		t.Fatalf("checkTarget() error = %v", err)
+	}
+	host, port, err := net.SplitHostPort(got)
+	if err != nil || port != "80" || !net.ParseIP(host).IsLoopback() {
+		t.Fatalf("checkTarget() = %q, want a loopback IP on port 80", got)
+	}
+}
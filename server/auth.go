@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+)
+
+const authNonceSize = 32
+const authTimeout = 10 * time.Second
+
+type AuthPayload struct {
+	Nonce string `json:"nonce,omitempty"`
+	Mac   string `json:"mac,omitempty"`
+}
+
+func newAuthNonce() ([]byte, error) {
+	nonce := make([]byte, authNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+func authMac(role string, first, second []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(config.AuthKey))
+	mac.Write([]byte(role))
+	mac.Write(first)
+	mac.Write(second)
+	return mac.Sum(nil)
+}
+func authenticateClient(conn net.Conn, writer *json.Encoder, reader *json.Decoder) error {
+	conn.SetDeadline(time.Now().Add(authTimeout))
+	defer conn.SetDeadline(time.Time{})
+	serverNonce, err := newAuthNonce()
+	if err != nil {
+		return err
+	}
+	if err := writeMessage(writer, msgAuthChallenge, AuthPayload{Nonce: hex.EncodeToString(serverNonce)}); err != nil {
+		return err
+	}
+	var response AuthPayload
+	if err := readMessage(reader, msgAuthResponse, &response); err != nil {
+		return err
+	}
+	clientNonce, err := hex.DecodeString(response.Nonce)
+	if err != nil || len(clientNonce) != authNonceSize {
+		return errors.New("malformed client nonce")
+	}
+	clientMac, err := hex.DecodeString(response.Mac)
+	if err != nil || !hmac.Equal(clientMac, authMac("client", serverNonce, clientNonce)) {
+		writeMessage(writer, msgAuthFailed, nil)
+		return errors.New("invalid authentication key")
+	}
+	return writeMessage(writer, msgAuthOk, AuthPayload{Mac: hex.EncodeToString(authMac("server", clientNonce, serverNonce))})
+}
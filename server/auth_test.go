@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func testAuthMac(key, role string, first, second []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(role))
+	mac.Write(first)
+	mac.Write(second)
+	return mac.Sum(nil)
+}
+func TestAuthenticateClient(t *testing.T) {
+	tests := []struct {
+		name        string
+		clientKey   string
+		clientNonce string
+		wantErr     bool
+	}{
+		{"matching key", "secret", "", false},
+		{"wrong key", "guess", "", true},
+		{"malformed nonce", "secret", "abcd", true},
+	}
+	config.AuthKey = "secret"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+			defer clientConn.Close()
+			errc := make(chan error, 1)
+			go func() {
+				defer serverConn.Close()
+				errc <- authenticateClient(serverConn, json.NewEncoder(serverConn), json.NewDecoder(serverConn))
+			}()
+			writer := json.NewEncoder(clientConn)
+			reader := json.NewDecoder(clientConn)
+			var challenge AuthPayload
+			if err := readMessage(reader, msgAuthChallenge, &challenge); err != nil {
+				t.Fatalf("reading challenge: %v", err)
+			}
+			serverNonce, _ := hex.DecodeString(challenge.Nonce)
+			clientNonce := make([]byte, authNonceSize)
+			response := AuthPayload{
+				Nonce: hex.EncodeToString(clientNonce),
+				Mac:   hex.EncodeToString(testAuthMac(tt.clientKey, "client", serverNonce, clientNonce)),
+			}
+			if tt.clientNonce != "" {
+				response.Nonce = tt.clientNonce
+			}
+			if err := writeMessage(writer, msgAuthResponse, response); err != nil {
+				t.Fatalf("writing response: %v", err)
+			}
+			if tt.clientNonce == "" {
+				var result AuthPayload
+				err := readMessage(reader, msgAuthOk, &result)
+				if tt.wantErr {
+					if err == nil {
+						t.Fatal("server accepted a wrong key")
+					}
+				} else if err != nil || result.Mac != hex.EncodeToString(testAuthMac("secret", "server", clientNonce, serverNonce)) {
+					t.Fatalf("server proof = %q, %v", result.Mac, err)
+				}
+			}
+			if err := <-errc; (err != nil) != tt.wantErr {
+				t.Fatalf("authenticateClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const certUsage = `Usage: g-tun-server cert <command> [flags]
+
+Commands:
+  ca           create a local CA (ca.pem, ca-key.pem)
+  server       issue a server certificate (self-signed unless -ca is given)
+  client       issue a client certificate signed by the local CA
+  fingerprint  print the SHA-256 SPKI pin of a certificate for TlsPinSHA256
+
+Run "g-tun-server cert <command> -h" for the flags of each command.`
+
+type certOptions struct {
+	keyType  string
+	days     int
+	dns      string
+	ips      string
+	name     string
+	caPath   string
+	caKey    string
+	certPath string
+	keyPath  string
+	force    bool
+}
+
+func runCertCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, certUsage)
+		return 2
+	}
+	if args[0] == "fingerprint" {
+		return runCertFingerprint(args[1:])
+	}
+	opts := certOptions{}
+	days := 365
+	if args[0] == "ca" {
+		days = 3650
+	}
+	flags := flag.NewFlagSet("cert "+args[0], flag.ContinueOnError)
+	flags.StringVar(&opts.keyType, "key-type", "ecdsa", "key algorithm: ecdsa, ed25519 or rsa")
+	flags.IntVar(&opts.days, "days", days, "validity in days")
+	flags.BoolVar(&opts.force, "force", false, "overwrite existing certificate and key files")
+	flags.StringVar(&opts.caPath, "ca", "", "CA certificate used to sign the new certificate")
+	flags.StringVar(&opts.caKey, "ca-key", "", "CA private key (defaults to the -ca path with -key.pem)")
+	switch args[0] {
+	case "ca":
+		flags.StringVar(&opts.name, "name", "G-Tun CA", "CA common name")
+		flags.StringVar(&opts.certPath, "out", "ca.pem", "certificate output path")
+		flags.StringVar(&opts.keyPath, "key-out", "ca-key.pem", "private key output path")
+	case "server":
+		flags.StringVar(&opts.name, "name", "G-Tun Server", "certificate common name")
+		flags.StringVar(&opts.dns, "dns", "", "comma separated DNS names for the SAN extension")
+		flags.StringVar(&opts.ips, "ip", "", "comma separated IP addresses for the SAN extension")
+		flags.StringVar(&opts.certPath, "out", "cert.pem", "certificate output path")
+		flags.StringVar(&opts.keyPath, "key-out", "key.pem", "private key output path")
+	case "client":
+		flags.StringVar(&opts.name, "name", "", "client name, used as common name and file prefix")
+		opts.caPath = "ca.pem"
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: unknown cert command %q\n\n%s\n", args[0], certUsage)
+		return 2
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if args[0] == "client" {
+		if opts.name == "" {
+			fmt.Fprintln(os.Stderr, "ERROR: -name is required for client certificates")
+			return 2
+		}
+		if opts.certPath == "" {
+			opts.certPath = opts.name + ".pem"
+			opts.keyPath = opts.name + "-key.pem"
+		}
+	}
+	if err := issueCertificate(args[0], opts); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	return 0
+}
+func runCertFingerprint(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: g-tun-server cert fingerprint <cert.pem>")
+		return 2
+	}
+	cert, err := readCertificate(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	fmt.Println(certPin(cert))
+	return 0
+}
+func certPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(digest[:])
+}
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s does not contain a PEM certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch strings.ToLower(keyType) {
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	return nil, fmt.Errorf("unknown key type %q (use ecdsa, ed25519 or rsa)", keyType)
+}
+func loadCA(certPath, keyPath string) (*x509.Certificate, crypto.Signer, error) {
+	if keyPath == "" {
+		keyPath = strings.TrimSuffix(certPath, ".pem") + "-key.pem"
+	}
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load CA %s/%s: %v (create one with \"g-tun-server cert ca\")", certPath, keyPath, err)
+	}
+	caCert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if !caCert.IsCA {
+		return nil, nil, fmt.Errorf("%s is not a CA certificate", certPath)
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("CA private key cannot sign certificates")
+	}
+	return caCert, signer, nil
+}
+func issueCertificate(kind string, opts certOptions) error {
+	if opts.days <= 0 {
+		return errors.New("-days must be positive")
+	}
+	if !opts.force {
+		for _, path := range []string{opts.certPath, opts.keyPath} {
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists, pass -force to overwrite it", path)
+			}
+		}
+	}
+	key, err := generateKey(opts.keyType)
+	if err != nil {
+		return err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Organization: []string{"MyTunnel Org"}, CommonName: opts.name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Duration(opts.days) * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	switch kind {
+	case "ca":
+		template.IsCA = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	case "server":
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		for _, name := range strings.Split(opts.dns, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				template.DNSNames = append(template.DNSNames, name)
+			}
+		}
+		for _, value := range strings.Split(opts.ips, ",") {
+			if value = strings.TrimSpace(value); value == "" {
+				continue
+			}
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return fmt.Errorf("invalid IP address %q", value)
+			}
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
+	case "client":
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	parent, signer := template, crypto.Signer(key)
+	if opts.caPath != "" && kind != "ca" {
+		parent, signer, err = loadCA(opts.caPath, opts.caKey)
+		if err != nil {
+			return err
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePemFile(opts.keyPath, "PRIVATE KEY", keyDer, 0600, opts.force); err != nil {
+		return err
+	}
+	if err := writePemFile(opts.certPath, "CERTIFICATE", der, 0644, opts.force); err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s and %s generated successfully (valid until %s).\n", opts.certPath, opts.keyPath, cert.NotAfter.Format("2006-01-02"))
+	switch kind {
+	case "ca":
+		fmt.Printf("Set ClientCAPath to %s in server_config.json to require client certificates, or TlsCAPath on clients to trust servers it signs.\n", opts.certPath)
+	case "server":
+		if len(template.DNSNames) == 0 && len(template.IPAddresses) == 0 {
+			fmt.Println("WARN: No -dns or -ip given, clients must pin this certificate instead of verifying its name.")
+		}
+		fmt.Println("TLS pin for client_config.json TlsPinSHA256: " + certPin(cert))
+	case "client":
+		fmt.Println("Copy them to the client and set TlsClientCertPath and TlsClientKeyPath in client_config.json.")
+	}
+	return nil
+}
+func writePemFile(path, blockType string, der []byte, perm os.FileMode, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	out, err := os.OpenFile(path, flags, perm)
+	if err != nil {
+		return err
+	}
+	if err := out.Chmod(perm); err != nil {
+		out.Close()
+		return err
+	}
+	if err := pem.Encode(out, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIssueCertificate(t *testing.T) {
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.pem")
+	caKeyPath := filepath.Join(dir, "ca-key.pem")
+	if err := issueCertificate("ca", certOptions{keyType: "ecdsa", days: 3650, name: "Test CA", certPath: caPath, keyPath: caKeyPath}); err != nil {
+		t.Fatalf("issuing CA: %v", err)
+	}
+	caCert, err := readCertificate(caPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !caCert.IsCA {
+		t.Fatal("CA certificate is not marked as a CA")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	tests := []struct {
+		name    string
+		kind    string
+		opts    certOptions
+		usage   x509.ExtKeyUsage
+		dnsName string
+		wantErr bool
+	}{
+		{"ca signed server", "server", certOptions{keyType: "ecdsa", days: 30, dns: "tunnel.example, alt.example", ips: "192.0.2.1", caPath: caPath}, x509.ExtKeyUsageServerAuth, "alt.example", false},
+		{"ed25519 server", "server", certOptions{keyType: "ed25519", days: 30, dns: "tunnel.example", caPath: caPath}, x509.ExtKeyUsageServerAuth, "tunnel.example", false},
+		{"rsa client", "client", certOptions{keyType: "rsa", days: 30, name: "laptop", caPath: caPath}, x509.ExtKeyUsageClientAuth, "", false},
+		{"self-signed server", "server", certOptions{keyType: "ecdsa", days: 30, ips: "192.0.2.1"}, x509.ExtKeyUsageServerAuth, "", false},
+		{"unknown key type", "server", certOptions{keyType: "dsa", days: 30}, 0, "", true},
+		{"zero days", "server", certOptions{keyType: "ecdsa", days: 0}, 0, "", true},
+		{"bad ip", "server", certOptions{keyType: "ecdsa", days: 30, ips: "300.1.1.1"}, 0, "", true},
+		{"missing ca", "client", certOptions{keyType: "ecdsa", days: 30, name: "x", caPath: filepath.Join(dir, "none.pem")}, 0, "", true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.certPath = filepath.Join(dir, tt.kind+string(rune('a'+i))+".pem")
+			tt.opts.keyPath = filepath.Join(dir, tt.kind+string(rune('a'+i))+"-key.pem")
+			err := issueCertificate(tt.kind, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("issueCertificate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			cert, err := readCertificate(tt.opts.certPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cert.IsCA {
+				t.Fatal("leaf certificate is marked as a CA")
+			}
+			if tt.opts.caPath == "" {
+				if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+					t.Fatalf("self-signed certificate does not verify against itself: %v", err)
+				}
+				if !cert.IPAddresses[0].Equal(net.ParseIP("192.0.2.1")) {
+					t.Fatalf("IP SANs = %v", cert.IPAddresses)
+				}
+				return
+			}
+			_, err = cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: tt.dnsName, KeyUsages: []x509.ExtKeyUsage{tt.usage}})
+			if err != nil {
+				t.Fatalf("certificate does not verify against the CA: %v", err)
+			}
+		})
+	}
+}
+func TestIssueCertificateOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	opts := certOptions{keyType: "ecdsa", days: 30, certPath: filepath.Join(dir, "cert.pem"), keyPath: filepath.Join(dir, "key.pem")}
+	if err := os.WriteFile(opts.keyPath, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := issueCertificate("server", opts); err == nil {
+		t.Fatal("issueCertificate() replaced an existing key without -force")
+	}
+	if data, _ := os.ReadFile(opts.keyPath); string(data) != "old" {
+		t.Fatal("existing key was modified without -force")
+	}
+	if _, err := os.Stat(opts.certPath); err == nil {
+		t.Fatal("certificate was written although the key already existed")
+	}
+	opts.force = true
+	if err := issueCertificate("server", opts); err != nil {
+		t.Fatalf("issueCertificate() with -force: %v", err)
+	}
+	info, err := os.Stat(opts.keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("overwritten key permissions = %o, want 600", perm)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+type httpEndpoint struct {
+	Port     string
+	Tls      bool
+	server   *http.Server
+	handlers map[string]http.Handler
+	mu       sync.RWMutex
+}
+type httpRegistration struct {
+	endpoint *httpEndpoint
+	path     string
+}
+
+var httpEndpoints = make(map[string]*httpEndpoint)
+var httpEndpointsMu sync.Mutex
+
+func (e *httpEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.RLock()
+	handler, ok := e.handlers[r.URL.Path]
+	e.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+func registerHttpHandler(port, path string, useTls bool, handler http.Handler) (*httpRegistration, error) {
+	httpEndpointsMu.Lock()
+	defer httpEndpointsMu.Unlock()
+	e, ok := httpEndpoints[port]
+	if ok {
+		if e.Tls != useTls {
+			return nil, fmt.Errorf("port %s is already serving a listener with TLS=%v", port, e.Tls)
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if _, taken := e.handlers[path]; taken {
+			return nil, fmt.Errorf("path %s is already registered on port %s", path, port)
+		}
+		e.handlers[path] = handler
+		return &httpRegistration{endpoint: e, path: path}, nil
+	}
+	e = &httpEndpoint{Port: port, Tls: useTls, handlers: map[string]http.Handler{path: handler}}
+	e.server = &http.Server{Addr: "0.0.0.0:" + port, Handler: e, ErrorLog: httpErrorLog()}
+	if useTls {
+		tlsConfig, err := serverTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		e.server.TLSConfig = tlsConfig
+	}
+	listener, err := net.Listen("tcp", e.server.Addr)
+	if err != nil {
+		return nil, err
+	}
+	addListener(e.server)
+	if useTls {
+		go e.server.ServeTLS(listener, "", "")
+	} else {
+		go e.server.Serve(listener)
+	}
+	httpEndpoints[port] = e
+	return &httpRegistration{endpoint: e, path: path}, nil
+}
+func (r *httpRegistration) Close() error {
+	httpEndpointsMu.Lock()
+	defer httpEndpointsMu.Unlock()
+	e := r.endpoint
+	e.mu.Lock()
+	delete(e.handlers, r.path)
+	remaining := len(e.handlers)
+	e.mu.Unlock()
+	if remaining > 0 || httpEndpoints[e.Port] != e {
+		return nil
+	}
+	delete(httpEndpoints, e.Port)
+	removeListener(e.server)
+	return e.server.Close()
+}
+
+type wsListener struct {
+	registration *httpRegistration
+	conns        chan net.Conn
+	done         chan struct{}
+	once         sync.Once
+	addr         net.Addr
+}
+
+func listenWs(port, path string, useTls bool) (*wsListener, error) {
+	l := &wsListener{conns: make(chan net.Conn), done: make(chan struct{})}
+	registration, err := registerHttpHandler(port, path, useTls, http.HandlerFunc(l.handle))
+	if err != nil {
+		return nil, err
+	}
+	l.registration = registration
+	l.addr, _ = net.ResolveTCPAddr("tcp", "0.0.0.0:"+port)
+	return l, nil
+}
+func (l *wsListener) handle(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn := &wsConnWrapper{Conn: ws}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+func (l *wsListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.registration.Close()
+	})
+	return err
+}
+func (l *wsListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+func (s *controlSession) probeCandidates() (*dataListener, error) {
+	var candidates []*dataListener
+	seen := make(map[string]bool)
+	for _, name := range configuredTransports() {
+		t, ok := findTransport(name)
+		if !ok {
+			log(fmt.Sprintf("WARN: Unknown transport '%s' in configuration, skipping.", name))
+			continue
+		}
+		if seen[t.Name] {
+			continue
+		}
+		seen[t.Name] = true
+		l, err := acquireTransport(t)
+		if err != nil {
+			log(fmt.Sprintf("WARN: Could not start %s listener: %v", t.Name, err))
+			continue
+		}
+		candidates = append(candidates, l)
+	}
+	if len(candidates) == 0 {
+		return nil, errors.New("none of the configured transports could be started")
+	}
+	chosen := candidates[0]
+	if len(candidates) > 1 && s.peerHasCapability("probe") {
+		chosen = s.probeForReachable(candidates)
+	}
+	for _, l := range candidates {
+		if l != chosen {
+			releaseTransport(l)
+		}
+	}
+	if chosen == nil {
+		return nil, errors.New("client could not reach any of the configured transports")
+	}
+	return chosen, nil
+}
+func (s *controlSession) probeForReachable(candidates []*dataListener) *dataListener {
+	var request ProbeRequestPayload
+	for _, l := range candidates {
+		request.Transports = append(request.Transports, transportPayload(l))
+	}
+	log(fmt.Sprintf("INFO: Asking %s to probe %d transports...", s, len(candidates)))
+	reply, err := s.request(msgProbeTransports, request)
+	if err != nil {
+		log(fmt.Sprintf("WARN: Probe by %s failed, using %s: %v", s, candidates[0].Transport.Name, err))
+		return candidates[0]
+	}
+	var result ProbeResultPayload
+	if err := decodePayload(reply, &result); err != nil {
+		log(fmt.Sprintf("WARN: Bad probe result from %s, using %s: %v", s, candidates[0].Transport.Name, err))
+		return candidates[0]
+	}
+	reachable := make(map[string]bool)
+	for _, r := range result.Results {
+		if r.Reachable {
+			reachable[r.Protocol] = true
+		} else {
+			log(fmt.Sprintf("INFO: %s cannot reach %s: %s", s, r.Protocol, r.Error))
+		}
+	}
+	for _, l := range candidates {
+		if reachable[l.Transport.Name] {
+			return l
+		}
+	}
+	return nil
+}
+func (s *controlSession) failover(reason string) {
+	if *interactive {
+		log(fmt.Sprintf("WARN: %s: %s. Automatic fallback is disabled in interactive mode.", s, reason))
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&s.failingOver, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&s.failingOver, 0)
+	log(fmt.Sprintf("WARN: %s: %s. Looking for a working transport...", s, reason))
+	l, err := s.probeCandidates()
+	if err != nil {
+		log(fmt.Sprintf("ERROR: Fallback for %s failed: %v", s, err))
+		return
+	}
+	defer releaseTransport(l)
+	current := s.currentListener()
+	if current != nil && current.Transport.Name == l.Transport.Name {
+		log(fmt.Sprintf("INFO: %s is still reachable for %s, restarting it.", l.Transport.Name, s))
+		s.send(msgStartTransport, transportPayload(l))
+		return
+	}
+	if err := s.switchTransport(l.Transport); err != nil {
+		log(fmt.Sprintf("ERROR: Could not fail over %s to %s: %v", s, l.Transport.Name, err))
+	}
+}
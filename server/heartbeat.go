@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const defaultHeartbeatInterval = 15
+const defaultHeartbeatTimeout = 45
+
+func heartbeatSettings() (time.Duration, time.Duration) {
+	interval := config.HeartbeatInterval
+	if interval <= 0 {
+		interval = defaultHeartbeatInterval
+	}
+	timeout := config.HeartbeatTimeout
+	if timeout <= 0 {
+		timeout = defaultHeartbeatTimeout
+	}
+	if timeout < interval {
+		timeout = interval * 3
+	}
+	return time.Duration(interval) * time.Second, time.Duration(timeout) * time.Second
+}
+func (s *controlSession) markSeen() {
+	atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+}
+func (s *controlSession) isAttachedTo(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn == conn
+}
+func (s *controlSession) heartbeat(conn net.Conn) {
+	interval, timeout := heartbeatSettings()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !s.isAttachedTo(conn) {
+			return
+		}
+		silence := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastSeen)))
+		if silence > timeout {
+			log(fmt.Sprintf("WARN: No heartbeat from %s for %s, declaring it dead.", s, silence.Round(time.Second)))
+			s.close()
+			return
+		}
+		if _, err := s.send(msgPing, PingPayload{Timestamp: time.Now().UnixNano()}); err != nil {
+			return
+		}
+	}
+}
+func (s *controlSession) handlePong(msg Message) {
+	var pong PingPayload
+	if err := decodePayload(msg, &pong); err != nil {
+		return
+	}
+	rtt := time.Since(time.Unix(0, pong.Timestamp))
+	log(fmt.Sprintf("HEARTBEAT: %s RTT %s", s, rtt.Round(time.Microsecond)))
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestResolveKcpConfig(t *testing.T) {
+	tuned := KcpConfig{NoDelay: 0, Interval: 100, Resend: 0, NoCongestion: 0, SndWnd: 512, RcvWnd: 1024, Mtu: 1350, Dscp: 46}
+	tests := []struct {
+		name    string
+		mode    string
+		change  func(*KcpConfig)
+		want    kcpPreset
+		wantErr bool
+	}{
+		{"manual keeps values", "", nil, kcpPreset{0, 100, 0, 0}, false},
+		{"fast3 preset", "fast3", nil, kcpPreset{1, 10, 2, 1}, false},
+		{"mode is case insensitive", "Normal", nil, kcpPreset{0, 40, 2, 1}, false},
+		{"unknown mode", "turbo", nil, kcpPreset{}, true},
+		{"mtu too small", "fast", func(c *KcpConfig) { c.Mtu = 500 }, kcpPreset{}, true},
+		{"mtu too large", "fast", func(c *KcpConfig) { c.Mtu = 9000 }, kcpPreset{}, true},
+		{"dscp out of range", "fast", func(c *KcpConfig) { c.Dscp = 64 }, kcpPreset{}, true},
+		{"negative buffer", "fast", func(c *KcpConfig) { c.ReadBuffer = -1 }, kcpPreset{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kcpConf := tuned
+			kcpConf.Mode = tt.mode
+			if tt.change != nil {
+				tt.change(&kcpConf)
+			}
+			got, err := resolveKcpConfig(kcpConf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveKcpConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if preset := (kcpPreset{got.NoDelay, got.Interval, got.Resend, got.NoCongestion}); preset != tt.want {
+				t.Fatalf("resolveKcpConfig() nodelay settings = %+v, want %+v", preset, tt.want)
+			}
+			if got.SndWnd != tuned.SndWnd || got.RcvWnd != tuned.RcvWnd || got.Mtu != tuned.Mtu || got.Dscp != tuned.Dscp {
+				t.Fatalf("a preset must only replace the nodelay settings, got %+v", got)
+			}
+		})
+	}
+}
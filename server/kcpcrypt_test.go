@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestKcpBlockCryptRoundTrip(t *testing.T) {
+	config.AuthKey = "secret"
+	for name := range kcpCiphers {
+		t.Run(name, func(t *testing.T) {
+			if err := setupKcpCrypt(KcpConfig{Crypt: name}); err != nil {
+				t.Fatalf("setupKcpCrypt(%s): %v", name, err)
+			}
+			sender, receiver := newKcpBlockCrypt(), newKcpBlockCrypt()
+			plain := make([]byte, 64)
+			for i := range plain {
+				plain[i] = byte(i)
+			}
+			sealed := make([]byte, len(plain))
+			sender.Encrypt(sealed, plain)
+			if bytes.Equal(sealed, plain) {
+				t.Fatal("Encrypt() left the packet unchanged")
+			}
+			opened := make([]byte, len(sealed))
+			receiver.Decrypt(opened, sealed)
+			if !bytes.Equal(opened, plain) {
+				t.Fatalf("Decrypt() = %x, want %x", opened, plain)
+			}
+		})
+	}
+}
+func TestChacha20BlockCrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	if _, err := newChacha20BlockCrypt(key[:16]); err == nil {
+		t.Fatal("newChacha20BlockCrypt() accepted a 16 byte key")
+	}
+	block, _ := newChacha20BlockCrypt(key)
+	other, _ := newChacha20BlockCrypt(bytes.Repeat([]byte{2}, 32))
+	plain := append(bytes.Repeat([]byte{9}, 16), []byte("kcp segment payload")...)
+	sealed := make([]byte, len(plain))
+	block.Encrypt(sealed, plain)
+	if !bytes.Equal(sealed[:12], plain[:12]) {
+		t.Fatal("Encrypt() must keep the nonce prefix in the clear")
+	}
+	opened := make([]byte, len(sealed))
+	other.Decrypt(opened, sealed)
+	if bytes.Equal(opened, plain) {
+		t.Fatal("a different key decrypted the packet")
+	}
+	block.Decrypt(opened, sealed)
+	if !bytes.Equal(opened, plain) {
+		t.Fatalf("Decrypt() = %q, want %q", opened, plain)
+	}
+}
+func TestSetupKcpCrypt(t *testing.T) {
+	config.AuthKey = "secret"
+	fingerprint := func(kcpConf KcpConfig) string {
+		if err := setupKcpCrypt(kcpConf); err != nil {
+			t.Fatalf("setupKcpCrypt(%+v): %v", kcpConf, err)
+		}
+		return kcpCryptFingerprint
+	}
+	if err := setupKcpCrypt(KcpConfig{Crypt: "rot13"}); err == nil {
+		t.Fatal("setupKcpCrypt() accepted an unknown cipher")
+	}
+	if fingerprint(KcpConfig{}) != fingerprint(KcpConfig{Crypt: "None"}) || newKcpBlockCrypt() != nil {
+		t.Fatal("an empty Crypt should mean no encryption")
+	}
+	if fingerprint(KcpConfig{Crypt: "aes"}) != fingerprint(KcpConfig{Crypt: "AES", Key: "secret"}) {
+		t.Fatal("an empty Key should fall back to AuthKey")
+	}
+	base := fingerprint(KcpConfig{Crypt: "aes", Key: "one"})
+	for _, kcpConf := range []KcpConfig{{Crypt: "aes", Key: "two"}, {Crypt: "salsa20", Key: "one"}, {}} {
+		if fingerprint(kcpConf) == base {
+			t.Fatalf("%+v has the same fingerprint as aes/one", kcpConf)
+		}
+	}
+}
+func TestKcpCryptMismatchRejected(t *testing.T) {
+	config.AuthKey = "secret"
+	if err := setupKcpCrypt(KcpConfig{Crypt: "aes", Key: "server"}); err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go handleControlConnection(serverConn)
+	writer := json.NewEncoder(clientConn)
+	reader := json.NewDecoder(clientConn)
+	var challenge AuthPayload
+	if err := readMessage(reader, msgAuthChallenge, &challenge); err != nil {
+		t.Fatal(err)
+	}
+	serverNonce, _ := hex.DecodeString(challenge.Nonce)
+	clientNonce := make([]byte, authNonceSize)
+	response := AuthPayload{Nonce: hex.EncodeToString(clientNonce), Mac: hex.EncodeToString(testAuthMac("secret", "client", serverNonce, clientNonce))}
+	if err := writeMessage(writer, msgAuthResponse, response); err != nil {
+		t.Fatal(err)
+	}
+	if err := readMessage(reader, msgAuthOk, nil); err != nil {
+		t.Fatal(err)
+	}
+	hello := HelloPayload{Version: protocolVersion, MinVersion: minProtocolVersion, KcpCrypt: kcpFingerprint("aes", []byte("client"))}
+	if err := writeMessage(writer, msgHello, hello); err != nil {
+		t.Fatal(err)
+	}
+	err := readMessage(reader, msgHello, nil)
+	var perr *peerError
+	if !errors.As(err, &perr) || perr.Code != errKcpCryptMismatch {
+		t.Fatalf("hello with a mismatched KCP key: got %v, want %s", err, errKcpCryptMismatch)
+	}
+}
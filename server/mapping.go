@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type Mapping struct {
+	Name   string
+	Target string
+}
+
+func mappingTarget(name string) (string, error) {
+	if name == "" {
+		return config.XrayInboundAddress, nil
+	}
+	for _, mapping := range config.Mappings {
+		if mapping.Name == name {
+			return mapping.Target, nil
+		}
+	}
+	return "", fmt.Errorf("%w: unknown mapping '%s'", errTargetDenied, name)
+}
+func dialMapping(header StreamHeader) (net.Conn, error) {
+	if header.Type != streamConnect {
+		return nil, fmt.Errorf("unexpected stream type '%s'", header.Type)
+	}
+	if header.Target != "" {
+		if header.Mapping != "" {
+			return nil, fmt.Errorf("stream names both mapping '%s' and target '%s'", header.Mapping, header.Target)
+		}
+		if findSession(header.Token) == nil {
+			return nil, fmt.Errorf("%w: target streams need the token of a control session", errTargetDenied)
+		}
+		return dialTarget(header.Target)
+	}
+	target, err := mappingTarget(header.Mapping)
+	if err != nil {
+		return nil, err
+	}
+	return net.Dial("tcp", target)
+}
+func dialStatus(err error) byte {
+	switch {
+	case err == nil:
+		return dialOk
+	case errors.Is(err, errTargetDenied):
+		return dialDenied
+	}
+	return dialFailed
+}
+func readConnHeader(conn net.Conn) (StreamHeader, error) {
+	conn.SetReadDeadline(time.Now().Add(streamHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	return readStreamHeader(conn)
+}
+func readWsHeader(wsConn *websocket.Conn) (StreamHeader, error) {
+	wsConn.SetReadDeadline(time.Now().Add(streamHeaderTimeout))
+	defer wsConn.SetReadDeadline(time.Time{})
+	_, message, err := wsConn.ReadMessage()
+	if err != nil {
+		return StreamHeader{}, err
+	}
+	return readStreamHeader(bytes.NewReader(message))
+}
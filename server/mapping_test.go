@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDialMappingRequiresSessionToken(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	defer func(saved *allowlist) { targetAllowlist = saved }(targetAllowlist)
+	if targetAllowlist, err = compileAllowlist(TargetAllowlist{CIDRs: []string{"127.0.0.0/8"}}); err != nil {
+		t.Fatal(err)
+	}
+	sessionsMu.Lock()
+	sessions["mapping-test"] = &controlSession{ID: "mapping-test", Token: "valid-token"}
+	sessionsMu.Unlock()
+	defer func() {
+		sessionsMu.Lock()
+		delete(sessions, "mapping-test")
+		sessionsMu.Unlock()
+	}()
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid token", "valid-token", false},
+		{"missing token", "", true},
+		{"unknown token", "guess", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := dialMapping(StreamHeader{Type: streamConnect, Token: tt.token, Target: listener.Addr().String()})
+			if err == nil {
+				conn.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dialMapping() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && (!strings.Contains(err.Error(), "token") || dialStatus(err) != dialDenied) {
+				t.Fatalf("dialMapping() error = %v, want a denied session token error", err)
+			}
+		})
+	}
+}
+func TestDialStatus(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := listener.Addr().String()
+	listener.Close()
+	defer func(saved *allowlist) { targetAllowlist = saved }(targetAllowlist)
+	if targetAllowlist, err = compileAllowlist(TargetAllowlist{CIDRs: []string{"127.0.0.0/8"}}); err != nil {
+		t.Fatal(err)
+	}
+	_, unknownMapping := dialMapping(StreamHeader{Type: streamConnect, Mapping: "missing"})
+	_, outsideAllowlist := checkTarget("192.0.2.1:80")
+	_, refused := dialTarget(closedPort)
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{"connected", nil, dialOk},
+		{"unknown mapping", unknownMapping, dialDenied},
+		{"outside allowlist", outsideAllowlist, dialDenied},
+		{"connection refused", refused, dialFailed},
+	}
+	for _, tt := range tests {
+		if got := dialStatus(tt.err); got != tt.want {
+			t.Errorf("%s: dialStatus(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
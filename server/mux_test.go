@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+func TestBuildMuxConfig(t *testing.T) {
+	defaults := smux.DefaultConfig()
+	tests := []struct {
+		name    string
+		muxConf MuxConfig
+		check   func(*smux.Config) bool
+		wantErr bool
+	}{
+		{"zero values keep smux defaults", MuxConfig{}, func(c *smux.Config) bool { return *c == *defaults }, false},
+		{"overrides", MuxConfig{Version: 2, KeepAliveInterval: 5, KeepAliveTimeout: 20, MaxFrameSize: 16384, MaxReceiveBuffer: 8 << 20, MaxStreamBuffer: 1 << 20}, func(c *smux.Config) bool {
+			return c.Version == 2 && c.KeepAliveInterval == 5*time.Second && c.KeepAliveTimeout == 20*time.Second && c.MaxFrameSize == 16384 && c.MaxReceiveBuffer == 8<<20 && c.MaxStreamBuffer == 1<<20
+		}, false},
+		{"keepalive disabled", MuxConfig{KeepAliveDisabled: true}, func(c *smux.Config) bool { return c.KeepAliveDisabled }, false},
+		{"unsupported version", MuxConfig{Version: 3}, nil, true},
+		{"timeout shorter than interval", MuxConfig{KeepAliveInterval: 30, KeepAliveTimeout: 10}, nil, true},
+		{"frame size too large", MuxConfig{MaxFrameSize: 70000}, nil, true},
+		{"stream buffer above receive buffer", MuxConfig{MaxReceiveBuffer: 65536, MaxStreamBuffer: 1 << 20}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildMuxConfig(tt.muxConf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildMuxConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !tt.check(got) {
+				t.Fatalf("buildMuxConfig() = %+v", *got)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		hello   HelloPayload
+		want    int
+		wantErr bool
+	}{
+		{"same range", HelloPayload{Version: protocolVersion, MinVersion: minProtocolVersion}, protocolVersion, false},
+		{"newer peer", HelloPayload{Version: protocolVersion + 1, MinVersion: minProtocolVersion}, protocolVersion, false},
+		{"peer too old", HelloPayload{Version: minProtocolVersion - 1, MinVersion: minProtocolVersion - 1}, 0, true},
+		{"peer requires newer", HelloPayload{Version: protocolVersion + 2, MinVersion: protocolVersion + 1}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := negotiateVersion(tt.hello)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("negotiateVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("negotiateVersion() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+func TestHasCapability(t *testing.T) {
+	capabilities := []string{"probe", "resume"}
+	if !hasCapability(capabilities, "resume") {
+		t.Fatal("hasCapability() missed a listed capability")
+	}
+	if hasCapability(capabilities, "stats") || hasCapability(nil, "probe") {
+		t.Fatal("hasCapability() reported an unlisted capability")
+	}
+}
+func streamHeaderFrame(length int, body string) []byte {
+	frame := make([]byte, 2, 2+len(body))
+	binary.BigEndian.PutUint16(frame, uint16(length))
+	return append(frame, body...)
+}
+func TestReadStreamHeader(t *testing.T) {
+	valid := `{"type":"connect","mapping":"web"}`
+	tests := []struct {
+		name    string
+		frame   []byte
+		want    StreamHeader
+		wantErr bool
+	}{
+		{"valid", streamHeaderFrame(len(valid), valid), StreamHeader{Type: streamConnect, Mapping: "web"}, false},
+		{"zero length", streamHeaderFrame(0, ""), StreamHeader{}, true},
+		{"too long", streamHeaderFrame(maxStreamHeaderSize+1, strings.Repeat("x", maxStreamHeaderSize+1)), StreamHeader{}, true},
+		{"truncated length", []byte{0x00}, StreamHeader{}, true},
+		{"truncated body", streamHeaderFrame(len(valid), valid[:10]), StreamHeader{}, true},
+		{"bad json", streamHeaderFrame(3, "{x}"), StreamHeader{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readStreamHeader(bytes.NewReader(tt.frame))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readStreamHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Fatalf("readStreamHeader() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+func TestStreamHeaderRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	want := StreamHeader{Type: streamConnect, Token: "abc", Target: "10.0.0.1:80"}
+	if err := writeStreamHeader(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readStreamHeader(&buf)
+	if err != nil || got != want {
+		t.Fatalf("readStreamHeader() = %+v, %v, want %+v", got, err, want)
+	}
+}
+func TestDatagramFraming(t *testing.T) {
+	tests := []struct {
+		name     string
+		addr     string
+		payload  []byte
+		wantErr  bool
+		truncate int
+	}{
+		{"with address", "10.0.0.1:53", []byte("query"), false, 0},
+		{"empty address", "", []byte("payload"), false, 0},
+		{"empty payload", "10.0.0.1:53", nil, false, 0},
+		{"largest payload", "", make([]byte, 65535), false, 0},
+		{"address too long", strings.Repeat("a", 256), []byte("x"), true, 0},
+		{"payload too large", "", make([]byte, 65536), true, 0},
+		{"truncated address", "10.0.0.1:53", []byte("x"), false, 10},
+		{"truncated payload", "10.0.0.1:53", []byte("query"), false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := writeDatagram(&buf, tt.addr, tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("writeDatagram() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			frame := buf.Bytes()
+			if tt.truncate > 0 {
+				frame = frame[:len(frame)-tt.truncate]
+			}
+			addr, payload, err := readDatagram(bytes.NewReader(frame))
+			if tt.truncate > 0 {
+				if err == nil {
+					t.Fatal("readDatagram() accepted a truncated frame")
+				}
+				return
+			}
+			if err != nil || addr != tt.addr || !bytes.Equal(payload, tt.payload) {
+				t.Fatalf("readDatagram() = %q, %d bytes, %v", addr, len(payload), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+type ReverseMapping struct {
+	Name       string
+	ListenPort string
+}
+
+const streamHeaderTimeout = 10 * time.Second
+
+func startReverseListeners() {
+	for _, mapping := range config.ReverseMappings {
+		listener, err := net.Listen("tcp", "0.0.0.0:"+mapping.ListenPort)
+		if err != nil {
+			log(fmt.Sprintf("ERROR: Could not start reverse listener '%s' on port %s: %v", mapping.Name, mapping.ListenPort, err))
+			continue
+		}
+		addListener(listener)
+		log(fmt.Sprintf("INFO: Reverse listener '%s' started on port %s.", mapping.Name, mapping.ListenPort))
+		go func(listener net.Listener, name string) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go handleReverseConnection(conn, name)
+			}
+		}(listener, mapping.Name)
+	}
+}
+func handleReverseConnection(conn net.Conn, name string) {
+	defer conn.Close()
+	mux := findReverseMux(name)
+	if mux == nil {
+		log(fmt.Sprintf("WARN: No client with a mux transport serves reverse mapping '%s', dropping %s.", name, conn.RemoteAddr().String()))
+		return
+	}
+	stream, err := mux.OpenStream()
+	if err != nil {
+		log(fmt.Sprintf("WARN: Could not open reverse stream for '%s': %v", name, err))
+		return
+	}
+	defer stream.Close()
+	if err := writeStreamHeader(stream, StreamHeader{Type: streamReverse, Mapping: name}); err != nil {
+		return
+	}
+	go relayConnections(stream, conn)
+	relayConnections(conn, stream)
+}
+func findReverseMux(name string) *smux.Session {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for _, s := range sessions {
+		if mux := s.reverseMux(name); mux != nil {
+			return mux
+		}
+	}
+	return nil
+}
+func (s *controlSession) reverseMux(name string) *smux.Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	serves := false
+	for _, mapping := range s.Reverse {
+		if mapping == name {
+			serves = true
+		}
+	}
+	if !serves {
+		return nil
+	}
+	var best *smux.Session
+	for _, mux := range s.muxSessions {
+		if !mux.IsClosed() && (best == nil || mux.NumStreams() < best.NumStreams()) {
+			best = mux
+		}
+	}
+	return best
+}
+func bindMuxSession(token string, mux *smux.Session) error {
+	session := findSession(token)
+	if session == nil {
+		return errors.New("unknown session token")
+	}
+	session.mu.Lock()
+	session.muxSessions = append(session.muxSessions, mux)
+	session.mu.Unlock()
+	log(fmt.Sprintf("INFO: %s bound a mux session for reverse mappings %v.", session, session.Reverse))
+	go func() {
+		<-mux.CloseChan()
+		session.mu.Lock()
+		defer session.mu.Unlock()
+		for i, bound := range session.muxSessions {
+			if bound == mux {
+				session.muxSessions = append(session.muxSessions[:i], session.muxSessions[i+1:]...)
+				return
+			}
+		}
+	}()
+	return nil
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -28,17 +32,47 @@ type KcpConfig struct {
 	RcvWnd       int
 	DataShards   int
 	ParityShards int
+	Crypt        string
+	Key          string
+	Mode         string
+	Mtu          int
+	AckNoDelay   bool
+	StreamMode   bool
+	WriteDelay   bool
+	Dscp         int
+	ReadBuffer   int
+	WriteBuffer  int
 }
 type ServerConfig struct {
-	ControlPort        string
-	DataPorts          map[string]string
-	XrayInboundAddress string
-	TlsCertPath        string
-	TlsKeyPath         string
-	KcpConfig          KcpConfig
+	ControlPort          string
+	DataPorts            map[string]string
+	XrayInboundAddress   string
+	TlsCertPath          string
+	TlsKeyPath           string
+	KcpConfig            KcpConfig
+	MuxConfig            MuxConfig
+	Transport            string
+	FallbackTransports   []string
+	AuthKey              string
+	SessionResumeTimeout int
+	DrainTimeout         int
+	UdpIdleTimeout       int
+	HeartbeatInterval    int
+	HeartbeatTimeout     int
+	ClientCAPath         string
+	CertExpiryWarnDays   int
+	Acme                 AcmeConfig
+	ReverseMappings      []ReverseMapping
+	Mappings             []Mapping
+	TargetAllowlist      TargetAllowlist
+	ControlTransport     string
+	ControlPath          string
 }
 
 var config ServerConfig
+var configMu sync.RWMutex
+var promptMu sync.Mutex
+var interactive = flag.Bool("interactive", false, "ask for the transport protocol on stdin instead of using server_config.json")
 var activeListeners []io.Closer
 var mu sync.Mutex
 var bufferPool = sync.Pool{
@@ -48,10 +82,6 @@ var bufferPool = sync.Pool{
 	},
 }
 
-type Message struct {
-	Command string `json:"command"`
-	Payload string `json:"payload"`
-}
 type wsConnWrapper struct {
 	*websocket.Conn
 	r io.Reader
@@ -72,6 +102,12 @@ func (c *wsConnWrapper) Read(b []byte) (int, error) {
 	}
 	return n, err
 }
+func (c *wsConnWrapper) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
 func (c *wsConnWrapper) Write(b []byte) (int, error) {
 	err := c.WriteMessage(websocket.BinaryMessage, b)
 	if err != nil {
@@ -94,44 +130,136 @@ func loadServerConfiguration() {
 		os.Exit(1)
 	}
 }
+func reloadServerConfiguration() {
+	file, err := os.Open("server_config.json")
+	if err != nil {
+		log(fmt.Sprintf("ERROR: Could not reload server_config.json: %v", err))
+		return
+	}
+	defer file.Close()
+	var reloaded ServerConfig
+	if err := json.NewDecoder(file).Decode(&reloaded); err != nil {
+		log(fmt.Sprintf("ERROR: Could not reload server_config.json: %v", err))
+		return
+	}
+	t, ok := findTransport(reloaded.Transport)
+	if !ok {
+		log(fmt.Sprintf("ERROR: Unknown transport '%s' in reloaded configuration.", reloaded.Transport))
+		return
+	}
+	configMu.Lock()
+	changed := !strings.EqualFold(config.Transport, reloaded.Transport)
+	config.Transport = reloaded.Transport
+	config.FallbackTransports = reloaded.FallbackTransports
+	configMu.Unlock()
+	log("INFO: Configuration reloaded.")
+	if changed {
+		switchAllSessions(t)
+	}
+}
+func switchAllSessions(t transportSpec) {
+	sessionsMu.Lock()
+	var targets []*controlSession
+	for _, s := range sessions {
+		targets = append(targets, s)
+	}
+	sessionsMu.Unlock()
+	for _, s := range targets {
+		go func(s *controlSession) {
+			if err := s.switchTransport(t); err != nil {
+				log(fmt.Sprintf("ERROR: Could not switch %s to %s: %v", s, t.Name, err))
+			}
+		}(s)
+	}
+}
 func addListener(l io.Closer) {
 	mu.Lock()
 	defer mu.Unlock()
 	activeListeners = append(activeListeners, l)
 }
+func removeListener(l io.Closer) {
+	mu.Lock()
+	defer mu.Unlock()
+	for i, active := range activeListeners {
+		if active == l {
+			activeListeners = append(activeListeners[:i], activeListeners[i+1:]...)
+			return
+		}
+	}
+}
 func relayConnections(dst io.Writer, src io.Reader) {
 	bufPtr := bufferPool.Get().(*[]byte)
 	defer bufferPool.Put(bufPtr)
 	io.CopyBuffer(dst, src, *bufPtr)
 }
-func handleTcpDataConnection(clientConn net.Conn) {
+
+type connTracker struct {
+	active int64
+}
+
+func (t *connTracker) add() {
+	atomic.AddInt64(&t.active, 1)
+}
+func (t *connTracker) done() {
+	atomic.AddInt64(&t.active, -1)
+}
+func (t *connTracker) Active() int64 {
+	return atomic.LoadInt64(&t.active)
+}
+func handleTcpDataConnection(clientConn net.Conn, tracker *connTracker) {
+	tracker.add()
+	defer tracker.done()
 	defer clientConn.Close()
-	xrayConn, err := net.Dial("tcp", config.XrayInboundAddress)
+	header, err := readConnHeader(clientConn)
+	if err != nil {
+		return
+	}
+	if header.Type == streamUdp {
+		serveUdpStream(clientConn, header, clientConn.RemoteAddr().String())
+		return
+	}
+	xrayConn, err := dialMapping(header)
+	clientConn.Write([]byte{dialStatus(err)})
 	if err != nil {
+		log(fmt.Sprintf("WARN: Could not connect %s to %s: %v", clientConn.RemoteAddr().String(), header, err))
 		return
 	}
 	defer xrayConn.Close()
 	go relayConnections(xrayConn, clientConn)
 	relayConnections(clientConn, xrayConn)
 }
-func startTcpDataListener() {
-	port := config.DataPorts["TCP"]
-	listener, _ := net.Listen("tcp", "0.0.0.0:"+port)
+func startTcpDataListener(port string, tracker *connTracker) (io.Closer, error) {
+	listener, err := net.Listen("tcp", "0.0.0.0:"+port)
+	if err != nil {
+		return nil, err
+	}
 	addListener(listener)
-	defer listener.Close()
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			return
+	go func() {
+		defer listener.Close()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleTcpDataConnection(conn, tracker)
 		}
-		go handleTcpDataConnection(conn)
-	}
+	}()
+	return listener, nil
 }
-func startUdpDataListener() {
-	port := config.DataPorts["UDP"]
-	udpAddr, _ := net.ResolveUDPAddr("udp", "0.0.0.0:"+port)
-	conn, _ := net.ListenUDP("udp", udpAddr)
+func startUdpDataListener(port string, tracker *connTracker) (io.Closer, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", "0.0.0.0:"+port)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
 	addListener(conn)
+	go serveUdpData(conn, tracker)
+	return conn, nil
+}
+func serveUdpData(conn *net.UDPConn, tracker *connTracker) {
 	defer conn.Close()
 	sessions := make(map[string]net.Conn)
 	var mapMutex sync.Mutex
@@ -150,7 +278,9 @@ func startUdpDataListener() {
 				continue
 			}
 			sessions[remoteAddr.String()] = xrayConn
+			tracker.add()
 			go func(udpConn *net.UDPConn, clientAddr *net.UDPAddr, tcpConn net.Conn) {
+				defer tracker.done()
 				tcpBufPtr := bufferPool.Get().(*[]byte)
 				defer bufferPool.Put(tcpBufPtr)
 				for {
@@ -177,17 +307,31 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 4096,
 }
 
-func wsHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		return
+func newWsHandler(tracker *connTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		tracker.add()
+		defer tracker.done()
+		handleWsDataConnection(conn)
 	}
-	handleWsDataConnection(conn)
 }
 func handleWsDataConnection(wsConn *websocket.Conn) {
 	defer wsConn.Close()
-	xrayConn, err := net.Dial("tcp", config.XrayInboundAddress)
+	header, err := readWsHeader(wsConn)
+	if err != nil {
+		return
+	}
+	if header.Type == streamUdp {
+		serveUdpStream(&wsConnWrapper{Conn: wsConn}, header, wsConn.RemoteAddr().String())
+		return
+	}
+	xrayConn, err := dialMapping(header)
+	wsConn.WriteMessage(websocket.BinaryMessage, []byte{dialStatus(err)})
 	if err != nil {
+		log(fmt.Sprintf("WARN: Could not connect %s to %s: %v", wsConn.RemoteAddr().String(), header, err))
 		return
 	}
 	defer xrayConn.Close()
@@ -225,150 +369,260 @@ func handleWsDataConnection(wsConn *websocket.Conn) {
 	}()
 	<-errChan
 }
-func startWsDataListener() {
-	port := config.DataPorts["WS"]
-	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", wsHandler)
-	server := &http.Server{Addr: "0.0.0.0:" + port, Handler: mux}
-	addListener(server)
-	server.ListenAndServe()
+func startHttpDataListener(port, path string, handler http.HandlerFunc, useTls bool) (io.Closer, error) {
+	return registerHttpHandler(port, path, useTls, handler)
 }
-func handleMuxStream(stream io.ReadWriteCloser) {
-	defer stream.Close()
-	xrayConn, err := net.Dial("tcp", config.XrayInboundAddress)
+func startWsDataListener(port string, tracker *connTracker) (io.Closer, error) {
+	return startHttpDataListener(port, "/ws", newWsHandler(tracker), false)
+}
+func handleMuxStream(session *smux.Session, stream *smux.Stream, tracker *connTracker) {
+	stream.SetReadDeadline(time.Now().Add(streamHeaderTimeout))
+	header, err := readStreamHeader(stream)
+	stream.SetReadDeadline(time.Time{})
 	if err != nil {
+		stream.Close()
 		return
 	}
-	defer xrayConn.Close()
-	go relayConnections(xrayConn, stream)
-	relayConnections(stream, xrayConn)
-}
-func startTcpMuxDataListener() {
-	port := config.DataPorts["TCPMux"]
-	listener, _ := net.Listen("tcp", "0.0.0.0:"+port)
-	addListener(listener)
-	defer listener.Close()
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			return
+	switch header.Type {
+	case streamConnect, streamUdp:
+	case streamBind:
+		stream.Close()
+		if err := bindMuxSession(header.Token, session); err != nil {
+			log(fmt.Sprintf("WARN: Rejected mux session bind: %v", err))
 		}
-		go func(c net.Conn) {
-			session, err := smux.Server(c, nil)
-			if err != nil {
-				return
-			}
-			for {
-				stream, err := session.AcceptStream()
-				if err != nil {
-					break
-				}
-				go handleMuxStream(stream)
-			}
-		}(conn)
+		return
+	default:
+		log(fmt.Sprintf("WARN: Unknown mux stream type '%s'.", header.Type))
+		stream.Close()
+		return
 	}
-}
-func wsmuxHandler(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
+	tracker.add()
+	defer tracker.done()
+	defer stream.Close()
+	if header.Type == streamUdp {
+		serveUdpStream(stream, header, "mux stream")
+		return
+	}
+	xrayConn, err := dialMapping(header)
+	stream.Write([]byte{dialStatus(err)})
 	if err != nil {
+		log(fmt.Sprintf("WARN: Could not connect mux stream to %s: %v", header, err))
 		return
 	}
-	session, err := smux.Server(&wsConnWrapper{Conn: ws}, nil)
+	defer xrayConn.Close()
+	go relayConnections(xrayConn, stream)
+	relayConnections(stream, xrayConn)
+}
+func serveMuxSession(conn io.ReadWriteCloser, tracker *connTracker) {
+	session, err := smux.Server(conn, muxConfig)
 	if err != nil {
+		conn.Close()
 		return
 	}
+	defer session.Close()
 	for {
 		stream, err := session.AcceptStream()
 		if err != nil {
-			session.Close()
 			return
 		}
-		go handleMuxStream(stream)
-	}
-}
-func startWsMuxDataListener() {
-	port := config.DataPorts["WSMux"]
-	mux := http.NewServeMux()
-	mux.HandleFunc("/wsmux", wsmuxHandler)
-	server := &http.Server{Addr: "0.0.0.0:" + port, Handler: mux}
-	addListener(server)
-	server.ListenAndServe()
-}
-func startWssDataListener() {
-	port := config.DataPorts["WSS"]
-	mux := http.NewServeMux()
-	mux.HandleFunc("/wss", wsHandler)
-	server := &http.Server{Addr: "0.0.0.0:" + port, Handler: mux}
-	addListener(server)
-	server.ListenAndServeTLS(config.TlsCertPath, config.TlsKeyPath)
-}
-func wssmuxHandler(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		return
+		go handleMuxStream(session, stream, tracker)
 	}
-	session, err := smux.Server(&wsConnWrapper{Conn: ws}, nil)
+}
+func startTcpMuxDataListener(port string, tracker *connTracker) (io.Closer, error) {
+	listener, err := net.Listen("tcp", "0.0.0.0:"+port)
 	if err != nil {
-		return
+		return nil, err
 	}
-	for {
-		stream, err := session.AcceptStream()
+	addListener(listener)
+	go func() {
+		defer listener.Close()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveMuxSession(conn, tracker)
+		}
+	}()
+	return listener, nil
+}
+func newWsMuxHandler(tracker *connTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			session.Close()
 			return
 		}
-		go handleMuxStream(stream)
+		serveMuxSession(&wsConnWrapper{Conn: ws}, tracker)
 	}
 }
-func startWssMuxDataListener() {
-	port := config.DataPorts["WSSMux"]
-	mux := http.NewServeMux()
-	mux.HandleFunc("/wssmux", wssmuxHandler)
-	server := &http.Server{Addr: "0.0.0.0:" + port, Handler: mux}
-	addListener(server)
-	server.ListenAndServeTLS(config.TlsCertPath, config.TlsKeyPath)
+func startWsMuxDataListener(port string, tracker *connTracker) (io.Closer, error) {
+	return startHttpDataListener(port, "/wsmux", newWsMuxHandler(tracker), false)
+}
+func startWssDataListener(port string, tracker *connTracker) (io.Closer, error) {
+	return startHttpDataListener(port, "/wss", newWsHandler(tracker), true)
+}
+func startWssMuxDataListener(port string, tracker *connTracker) (io.Closer, error) {
+	return startHttpDataListener(port, "/wssmux", newWsMuxHandler(tracker), true)
 }
-func startUtcpMuxDataListener() {
-	port := config.DataPorts["UTCPMux"]
+func startUtcpMuxDataListener(port string, tracker *connTracker) (io.Closer, error) {
 	kcpConf := config.KcpConfig
-	listener, err := kcp.ListenWithOptions("0.0.0.0:"+port, nil, kcpConf.DataShards, kcpConf.ParityShards)
+	listener, err := kcp.ListenWithOptions("0.0.0.0:"+port, newKcpBlockCrypt(), kcpConf.DataShards, kcpConf.ParityShards)
 	if err != nil {
-		return
+		return nil, err
 	}
+	tuneKcpSocket(listener, kcpConf)
 	addListener(listener)
-	for {
-		conn, err := listener.AcceptKCP()
-		if err != nil {
-			return
-		}
-		conn.SetNoDelay(kcpConf.NoDelay, kcpConf.Interval, kcpConf.Resend, kcpConf.NoCongestion)
-		conn.SetWindowSize(kcpConf.SndWnd, kcpConf.RcvWnd)
-		go func(c net.Conn) {
-			session, err := smux.Server(c, nil)
+	go func() {
+		for {
+			conn, err := listener.AcceptKCP()
 			if err != nil {
 				return
 			}
-			for {
-				stream, err := session.AcceptStream()
-				if err != nil {
-					break
-				}
-				go handleMuxStream(stream)
-			}
-		}(conn)
+			tuneKcpSession(conn, kcpConf)
+			go serveMuxSession(conn, tracker)
+		}
+	}()
+	return listener, nil
+}
+
+type transportSpec struct {
+	Name    string
+	Label   string
+	PortKey string
+	Start   func(port string, tracker *connTracker) (io.Closer, error)
+}
+
+var transports = []transportSpec{
+	{"tcp", "TCP", "TCP", startTcpDataListener},
+	{"udp", "UDP", "UDP", startUdpDataListener},
+	{"ws", "WebSocket (WS)", "WS", startWsDataListener},
+	{"tcpmux", "TCPMux", "TCPMux", startTcpMuxDataListener},
+	{"wsmux", "WSMux", "WSMux", startWsMuxDataListener},
+	{"wss", "WebSocket Secure (WSS)", "WSS", startWssDataListener},
+	{"wssmux", "WSSMux", "WSSMux", startWssMuxDataListener},
+	{"utcpmux", "UTCPMux (KCP)", "UTCPMux", startUtcpMuxDataListener},
+}
+
+func findTransport(name string) (transportSpec, bool) {
+	for _, t := range transports {
+		if strings.EqualFold(t.Name, name) || strings.EqualFold(t.PortKey, name) {
+			return t, true
+		}
 	}
+	return transportSpec{}, false
+}
+func configuredTransports() []string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return append([]string{config.Transport}, config.FallbackTransports...)
+}
+func selectInteractiveTransport() (*dataListener, error) {
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	fmt.Println("\n--- Transport Protocol Selection ---")
+	for i, t := range transports {
+		fmt.Printf("%d. %s\n", i+1, t.Label)
+	}
+	fmt.Print("Enter your choice: ")
+	reader := bufio.NewReader(os.Stdin)
+	choice, _ := reader.ReadString('\n')
+	index, err := strconv.Atoi(strings.TrimSpace(choice))
+	if err != nil || index < 1 || index > len(transports) {
+		return nil, fmt.Errorf("invalid choice")
+	}
+	return acquireTransport(transports[index-1])
 }
 
+func controlTransport() string {
+	if config.ControlTransport == "" {
+		return "tcp"
+	}
+	return strings.ToLower(config.ControlTransport)
+}
+func startControlListener() (net.Listener, error) {
+	path := config.ControlPath
+	if path == "" {
+		path = "/control"
+	}
+	switch controlTransport() {
+	case "tcp":
+		return net.Listen("tcp", "0.0.0.0:"+config.ControlPort)
+	case "tls":
+		tlsConfig, err := serverTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		return tls.Listen("tcp", "0.0.0.0:"+config.ControlPort, tlsConfig)
+	case "ws":
+		return listenWs(config.ControlPort, path, false)
+	case "wss":
+		return listenWs(config.ControlPort, path, true)
+	}
+	return nil, fmt.Errorf("unknown control transport %q", config.ControlTransport)
+}
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "cert" {
+		os.Exit(runCertCommand(os.Args[2:]))
+	}
+	flag.Parse()
 	loadServerConfiguration()
+	if !*interactive && config.Transport == "" {
+		log("FATAL: No Transport set in server_config.json. Set one or run with -interactive.")
+		os.Exit(1)
+	}
+	if config.AuthKey == "" {
+		log("FATAL: No AuthKey set in server_config.json.")
+		os.Exit(1)
+	}
+	if err := setupKcpCrypt(config.KcpConfig); err != nil {
+		log(fmt.Sprintf("FATAL: Invalid KCP crypto settings: %v", err))
+		os.Exit(1)
+	}
+	kcpConf, err := resolveKcpConfig(config.KcpConfig)
+	if err != nil {
+		log(fmt.Sprintf("FATAL: Invalid KCP settings: %v", err))
+		os.Exit(1)
+	}
+	config.KcpConfig = kcpConf
+	muxConfig, err = buildMuxConfig(config.MuxConfig)
+	if err != nil {
+		log(fmt.Sprintf("FATAL: Invalid MuxConfig: %v", err))
+		os.Exit(1)
+	}
+	targetAllowlist, err = compileAllowlist(config.TargetAllowlist)
+	if err != nil {
+		log(fmt.Sprintf("FATAL: Invalid TargetAllowlist: %v", err))
+		os.Exit(1)
+	}
+	if err := validateAcmeConfig(); err != nil {
+		log(fmt.Sprintf("FATAL: Invalid Acme settings: %v", err))
+		os.Exit(1)
+	}
 	quitChannel := make(chan os.Signal, 1)
 	signal.Notify(quitChannel, os.Interrupt, syscall.SIGTERM)
+	reloadChannel := make(chan os.Signal, 1)
+	signal.Notify(reloadChannel, syscall.SIGHUP)
+	go func() {
+		for range reloadChannel {
+			reloadServerConfiguration()
+			serverCert.reload()
+		}
+	}()
+	statsChannel := make(chan os.Signal, 1)
+	signal.Notify(statsChannel, syscall.SIGUSR1)
+	go func() {
+		for range statsChannel {
+			requestStatsFromAllSessions()
+		}
+	}()
 	log("Control Server is starting...")
-	listener, err := net.Listen("tcp", "0.0.0.0:"+config.ControlPort)
+	listener, err := startControlListener()
 	if err != nil {
+		log(fmt.Sprintf("FATAL: Could not start control listener: %v", err))
 		os.Exit(1)
 	}
 	addListener(listener)
+	startReverseListeners()
 	go func() {
 		<-quitChannel
 		log("INFO: Shutdown signal received. Closing all listeners...")
@@ -380,69 +634,155 @@ func main() {
 		log("INFO: All listeners closed. Exiting.")
 		os.Exit(0)
 	}()
-	log(fmt.Sprintf("Waiting for control client to connect on %s", config.ControlPort))
-	conn, err := listener.Accept()
-	if err != nil {
-		if !strings.Contains(err.Error(), "use of closed network connection") {
-			log(fmt.Sprintf("FATAL: Could not accept control client: %v", err))
+	log(fmt.Sprintf("Waiting for control clients to connect on %s (%s)", config.ControlPort, controlTransport()))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				log(fmt.Sprintf("FATAL: Could not accept control client: %v", err))
+			}
+			return
 		}
-		return
+		go handleControlConnection(conn)
 	}
-	handleControlConnection(conn)
 }
 func handleControlConnection(conn net.Conn) {
 	defer conn.Close()
-	log(fmt.Sprintf("INFO: Control client connected from %s", conn.RemoteAddr().String()))
-	fmt.Println("\n--- Transport Protocol Selection ---")
-	fmt.Println("1. TCP")
-	fmt.Println("2. UDP")
-	fmt.Println("3. WebSocket (WS)")
-	fmt.Println("4. TCPMux")
-	fmt.Println("5. WSMux")
-	fmt.Println("6. WebSocket Secure (WSS)")
-	fmt.Println("7. WSSMux")
-	fmt.Println("8. UTCPMux (KCP)")
-	fmt.Print("Enter your choice: ")
-	reader := bufio.NewReader(os.Stdin)
-	choice, _ := reader.ReadString('\n')
-	choice = strings.TrimSpace(choice)
 	writer := json.NewEncoder(conn)
-	var proto, port string
-	switch choice {
-	case "1":
-		proto, port = "tcp", config.DataPorts["TCP"]
-		go startTcpDataListener()
-	case "2":
-		proto, port = "udp", config.DataPorts["UDP"]
-		go startUdpDataListener()
-	case "3":
-		proto, port = "ws", config.DataPorts["WS"]
-		go startWsDataListener()
-	case "4":
-		proto, port = "tcpmux", config.DataPorts["TCPMux"]
-		go startTcpMuxDataListener()
-	case "5":
-		proto, port = "wsmux", config.DataPorts["WSMux"]
-		go startWsMuxDataListener()
-	case "6":
-		proto, port = "wss", config.DataPorts["WSS"]
-		go startWssDataListener()
-	case "7":
-		proto, port = "wssmux", config.DataPorts["WSSMux"]
-		go startWssMuxDataListener()
-	case "8":
-		proto, port = "utcpmux", config.DataPorts["UTCPMux"]
-		go startUtcpMuxDataListener()
-	default:
-		log("Invalid choice")
-		conn.Close()
-		os.Exit(1)
+	reader := json.NewDecoder(conn)
+	if err := authenticateClient(conn, writer, reader); err != nil {
+		log(fmt.Sprintf("WARN: Rejected control client from %s: %v", conn.RemoteAddr().String(), err))
+		return
+	}
+	var hello HelloPayload
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	if err := readMessage(reader, msgHello, &hello); err != nil {
+		log(fmt.Sprintf("WARN: Control client %s did not send hello: %v", conn.RemoteAddr().String(), err))
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	version, err := negotiateVersion(hello)
+	if err != nil {
+		log(fmt.Sprintf("WARN: Rejected control client from %s: %v", conn.RemoteAddr().String(), err))
+		writeMessage(writer, msgError, ErrorPayload{Code: errIncompatibleVersion, Message: err.Error()})
+		return
+	}
+	if hello.KcpCrypt != "" && hello.KcpCrypt != kcpCryptFingerprint {
+		log(fmt.Sprintf("ERROR: Rejected control client from %s: KcpConfig Crypt/Key do not match this server.", conn.RemoteAddr().String()))
+		writeMessage(writer, msgError, ErrorPayload{Code: errKcpCryptMismatch, Message: "KcpConfig Crypt/Key do not match the server"})
+		return
+	}
+	var session *controlSession
+	if hello.SessionToken != "" {
+		session = resumeControlSession(hello.SessionToken, conn, writer, reader)
+	}
+	resumed := session != nil
+	if resumed {
+		log(fmt.Sprintf("INFO: Control client resumed: %s", session))
+	} else {
+		session, err = newControlSession(conn, writer, reader)
+		if err != nil {
+			log(fmt.Sprintf("ERROR: Could not create session for %s: %v", conn.RemoteAddr().String(), err))
+			return
+		}
+		log(fmt.Sprintf("INFO: Control client connected: %s (protocol v%d)", session, version))
+	}
+	session.setPeer(version, hello.Capabilities)
+	session.mu.Lock()
+	session.Reverse = hello.Reverse
+	session.mu.Unlock()
+	defer session.detach(conn)
+	reply := HelloPayload{
+		Version:      version,
+		MinVersion:   minProtocolVersion,
+		Capabilities: serverCapabilities(),
+		SessionID:    session.ID,
+		SessionToken: session.Token,
+		Resumed:      resumed,
+		KcpCrypt:     kcpCryptFingerprint,
+	}
+	if err := session.reply(0, msgHello, reply); err != nil {
 		return
 	}
-	log(fmt.Sprintf("INFO: User selected %s. Sending command to client...", proto))
-	payload := fmt.Sprintf(`{"protocol":"%s","port":"%s"}`, proto, port)
-	msg := Message{Command: "start_transport", Payload: payload}
-	writer.Encode(msg)
-	log(fmt.Sprintf("INFO: %s command sent. Data listener is running.", strings.ToUpper(proto)))
-	select {}
+	session.markSeen()
+	go session.heartbeat(conn)
+	go session.establishTransport(resumed)
+	for {
+		var msg Message
+		if err := reader.Decode(&msg); err != nil {
+			break
+		}
+		session.markSeen()
+		handleControlMessage(session, msg)
+	}
+	log(fmt.Sprintf("INFO: Control client disconnected: %s", session))
+}
+func serverCapabilities() []string {
+	capabilities := []string{"resume", "stats", "probe"}
+	for _, t := range transports {
+		capabilities = append(capabilities, t.Name)
+	}
+	return capabilities
+}
+func handleControlMessage(session *controlSession, msg Message) {
+	switch msg.Type {
+	case msgPing:
+		var ping PingPayload
+		if err := decodePayload(msg, &ping); err != nil {
+			session.replyError(msg.ID, errBadPayload, err.Error())
+			return
+		}
+		session.reply(msg.ID, msgPong, ping)
+	case msgPong:
+		session.completeRequest(msg)
+		session.handlePong(msg)
+	case msgProbeResult:
+		session.completeRequest(msg)
+	case msgAck:
+		request, _ := session.completeRequest(msg)
+		log(fmt.Sprintf("INFO: %s acknowledged %s.", session, request))
+	case msgStats:
+		session.completeRequest(msg)
+		var stats StatsPayload
+		if err := decodePayload(msg, &stats); err != nil {
+			log(fmt.Sprintf("WARN: Bad stats from %s: %v", session, err))
+			return
+		}
+		log(fmt.Sprintf("STATS: %s %s:%s up %ds, %d active / %d total connections, %d bytes sent, %d bytes received",
+			session, stats.Protocol, stats.Port, stats.UptimeSeconds, stats.ActiveConnections, stats.TotalConnections, stats.BytesSent, stats.BytesReceived))
+	case msgTransportFailed:
+		var failed TransportFailedPayload
+		if err := decodePayload(msg, &failed); err != nil {
+			session.replyError(msg.ID, errBadPayload, err.Error())
+			return
+		}
+		current := session.currentListener()
+		if current == nil || current.Transport.Name != failed.Protocol {
+			return
+		}
+		go session.failover(fmt.Sprintf("client reports %s failing: %s", failed.Protocol, failed.Error))
+	case msgError:
+		request, waited := session.completeRequest(msg)
+		if waited {
+			return
+		}
+		var e ErrorPayload
+		decodePayload(msg, &e)
+		log(fmt.Sprintf("ERROR: %s reported %s for %s: %s", session, e.Code, request, e.Message))
+		if request == msgStartTransport {
+			go session.failover(fmt.Sprintf("client could not start transport: %s", e.Message))
+		}
+	default:
+		log(fmt.Sprintf("WARN: Unknown message type '%s' from %s.", msg.Type, session))
+		session.replyError(msg.ID, errUnknownType, fmt.Sprintf("unknown message type '%s'", msg.Type))
+	}
+}
+func requestStatsFromAllSessions() {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for _, s := range sessions {
+		if _, err := s.send(msgStats, nil); err != nil {
+			log(fmt.Sprintf("WARN: Could not request stats from %s: %v", s, err))
+		}
+	}
 }
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+type dataListener struct {
+	Transport transportSpec
+	Port      string
+	tracker   *connTracker
+	closer    io.Closer
+	refs      int
+}
+type controlSession struct {
+	ID           string
+	Token        string
+	RemoteAddr   string
+	Transport    string
+	Listeners    []*dataListener
+	ConnectedAt  time.Time
+	Version      int
+	Capabilities []string
+	conn         net.Conn
+	writer       *json.Encoder
+	reader       *json.Decoder
+	mu           sync.Mutex
+	addrMu       sync.Mutex
+	detachTimer  *time.Timer
+	nextID       uint64
+	pending      map[uint64]string
+	waiters      map[uint64]chan Message
+	failingOver  int32
+	lastSeen     int64
+	Reverse      []string
+	muxSessions  []*smux.Session
+}
+
+const defaultSessionResumeTimeout = 120
+const defaultDrainTimeout = 30
+const requestTimeout = 30 * time.Second
+
+var dataListeners = make(map[string]*dataListener)
+var dataListenersMu sync.Mutex
+var sessions = make(map[string]*controlSession)
+var sessionsMu sync.Mutex
+var sessionCounter uint64
+
+func acquireTransport(t transportSpec) (*dataListener, error) {
+	dataListenersMu.Lock()
+	defer dataListenersMu.Unlock()
+	if l, ok := dataListeners[t.Name]; ok {
+		l.refs++
+		return l, nil
+	}
+	port := config.DataPorts[t.PortKey]
+	if port == "" {
+		return nil, fmt.Errorf("no DataPorts entry for %s", t.PortKey)
+	}
+	tracker := &connTracker{}
+	closer, err := t.Start(port, tracker)
+	if err != nil {
+		return nil, err
+	}
+	l := &dataListener{Transport: t, Port: port, tracker: tracker, closer: closer, refs: 1}
+	dataListeners[t.Name] = l
+	log(fmt.Sprintf("INFO: %s data listener started on port %s.", t.Name, port))
+	return l, nil
+}
+func releaseTransport(l *dataListener) {
+	dataListenersMu.Lock()
+	defer dataListenersMu.Unlock()
+	l.refs--
+	if l.refs > 0 {
+		return
+	}
+	delete(dataListeners, l.Transport.Name)
+	removeListener(l.closer)
+	l.closer.Close()
+	log(fmt.Sprintf("INFO: %s data listener on port %s closed.", l.Transport.Name, l.Port))
+}
+func drainTransport(l *dataListener) {
+	dataListenersMu.Lock()
+	shared := l.refs > 1
+	dataListenersMu.Unlock()
+	if !shared {
+		timeout := config.DrainTimeout
+		if timeout <= 0 {
+			timeout = defaultDrainTimeout
+		}
+		deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+		for l.tracker.Active() > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Second)
+		}
+		if active := l.tracker.Active(); active > 0 {
+			log(fmt.Sprintf("WARN: %s listener still has %d active connections after %ds, closing anyway.", l.Transport.Name, active, timeout))
+		}
+	}
+	releaseTransport(l)
+}
+func newSessionToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+func newControlSession(conn net.Conn, writer *json.Encoder, reader *json.Decoder) (*controlSession, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return nil, err
+	}
+	s := &controlSession{
+		ID:          fmt.Sprintf("%d", atomic.AddUint64(&sessionCounter, 1)),
+		Token:       token,
+		RemoteAddr:  conn.RemoteAddr().String(),
+		ConnectedAt: time.Now(),
+		conn:        conn,
+		writer:      writer,
+		reader:      reader,
+		pending:     make(map[uint64]string),
+		waiters:     make(map[uint64]chan Message),
+	}
+	sessionsMu.Lock()
+	sessions[s.ID] = s
+	sessionsMu.Unlock()
+	return s, nil
+}
+func resumeControlSession(token string, conn net.Conn, writer *json.Encoder, reader *json.Decoder) *controlSession {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for _, s := range sessions {
+		if s.Token != token {
+			continue
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.detachTimer != nil {
+			s.detachTimer.Stop()
+			s.detachTimer = nil
+		}
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.addrMu.Lock()
+		s.RemoteAddr = conn.RemoteAddr().String()
+		s.addrMu.Unlock()
+		s.ConnectedAt = time.Now()
+		s.conn = conn
+		s.writer = writer
+		s.reader = reader
+		return s
+	}
+	return nil
+}
+func findSession(token string) *controlSession {
+	if token == "" {
+		return nil
+	}
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for _, s := range sessions {
+		if s.Token == token {
+			return s
+		}
+	}
+	return nil
+}
+func (s *controlSession) send(msgType string, payload interface{}) (uint64, error) {
+	return s.sendWithWaiter(msgType, payload, nil)
+}
+func (s *controlSession) sendWithWaiter(msgType string, payload interface{}, waiter chan Message) (uint64, error) {
+	msg, err := newMessage(msgType, payload)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return 0, fmt.Errorf("%s is detached", s)
+	}
+	s.nextID++
+	msg.ID = s.nextID
+	s.pending[msg.ID] = msgType
+	if waiter != nil {
+		s.waiters[msg.ID] = waiter
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(requestTimeout))
+	return msg.ID, s.writer.Encode(msg)
+}
+func (s *controlSession) request(msgType string, payload interface{}) (Message, error) {
+	waiter := make(chan Message, 1)
+	id, err := s.sendWithWaiter(msgType, payload, waiter)
+	if err != nil {
+		return Message{}, err
+	}
+	select {
+	case reply := <-waiter:
+		if reply.Type == msgError {
+			var e ErrorPayload
+			decodePayload(reply, &e)
+			return reply, fmt.Errorf("%s: %s", e.Code, e.Message)
+		}
+		return reply, nil
+	case <-time.After(requestTimeout):
+		s.mu.Lock()
+		delete(s.waiters, id)
+		delete(s.pending, id)
+		s.mu.Unlock()
+		return Message{}, fmt.Errorf("no reply to %s within %s", msgType, requestTimeout)
+	}
+}
+func (s *controlSession) reply(replyTo uint64, msgType string, payload interface{}) error {
+	msg, err := newMessage(msgType, payload)
+	if err != nil {
+		return err
+	}
+	msg.ReplyTo = replyTo
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return fmt.Errorf("%s is detached", s)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(requestTimeout))
+	return s.writer.Encode(msg)
+}
+func (s *controlSession) replyError(replyTo uint64, code, message string) error {
+	return s.reply(replyTo, msgError, ErrorPayload{Code: code, Message: message})
+}
+func (s *controlSession) completeRequest(reply Message) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgType := s.pending[reply.ReplyTo]
+	delete(s.pending, reply.ReplyTo)
+	waiter, ok := s.waiters[reply.ReplyTo]
+	if ok {
+		delete(s.waiters, reply.ReplyTo)
+		waiter <- reply
+	}
+	return msgType, ok
+}
+func (s *controlSession) currentListener() *dataListener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.Listeners) == 0 {
+		return nil
+	}
+	return s.Listeners[len(s.Listeners)-1]
+}
+func (s *controlSession) switchTransport(t transportSpec) error {
+	old := s.currentListener()
+	if old != nil && old.Transport.Name == t.Name {
+		return nil
+	}
+	l, err := acquireTransport(t)
+	if err != nil {
+		return err
+	}
+	log(fmt.Sprintf("INFO: Switching %s to %s...", s, t.Name))
+	if _, err := s.request(msgSwitchTransport, transportPayload(l)); err != nil {
+		releaseTransport(l)
+		if old != nil {
+			s.send(msgStartTransport, transportPayload(old))
+		}
+		return err
+	}
+	s.mu.Lock()
+	var remaining []*dataListener
+	for _, existing := range s.Listeners {
+		if existing != old {
+			remaining = append(remaining, existing)
+		}
+	}
+	s.Listeners = append(remaining, l)
+	s.Transport = t.Name
+	s.mu.Unlock()
+	log(fmt.Sprintf("INFO: %s switched to %s.", s, t.Name))
+	if old != nil {
+		go drainTransport(old)
+	}
+	return nil
+}
+func (s *controlSession) detach(conn net.Conn) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != conn {
+		return
+	}
+	s.conn = nil
+	conn.Close()
+	timeout := config.SessionResumeTimeout
+	if timeout <= 0 {
+		timeout = defaultSessionResumeTimeout
+	}
+	log(fmt.Sprintf("INFO: %s detached, keeping it for %d seconds.", s, timeout))
+	s.detachTimer = time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+		sessionsMu.Lock()
+		s.mu.Lock()
+		expired := s.conn == nil
+		s.mu.Unlock()
+		if expired {
+			delete(sessions, s.ID)
+		}
+		sessionsMu.Unlock()
+		if expired {
+			log(fmt.Sprintf("INFO: %s expired.", s))
+			s.close()
+		}
+	})
+}
+func (s *controlSession) setPeer(version int, capabilities []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Version = version
+	s.Capabilities = capabilities
+}
+func (s *controlSession) peerHasCapability(capability string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return hasCapability(s.Capabilities, capability)
+}
+func (s *controlSession) addListener(l *dataListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Listeners = append(s.Listeners, l)
+	s.Transport = l.Transport.Name
+}
+func (s *controlSession) close() {
+	sessionsMu.Lock()
+	delete(sessions, s.ID)
+	sessionsMu.Unlock()
+	s.mu.Lock()
+	listeners := s.Listeners
+	s.Listeners = nil
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	s.mu.Unlock()
+	for _, l := range listeners {
+		releaseTransport(l)
+	}
+}
+func transportPayload(l *dataListener) TransportPayload {
+	payload := TransportPayload{Protocol: l.Transport.Name, Port: l.Port}
+	if l.Transport.Name == "utcpmux" {
+		payload.Kcp = newKcpParams(config.KcpConfig)
+	}
+	return payload
+}
+func (s *controlSession) establishTransport(resumed bool) {
+	if !resumed || s.currentListener() == nil {
+		var l *dataListener
+		var err error
+		if *interactive {
+			l, err = selectInteractiveTransport()
+		} else {
+			l, err = s.probeCandidates()
+		}
+		if err != nil {
+			log(fmt.Sprintf("ERROR: No transport for %s: %v", s, err))
+			s.replyError(0, "no_transport", err.Error())
+			s.close()
+			return
+		}
+		s.addListener(l)
+	}
+	l := s.currentListener()
+	log(fmt.Sprintf("INFO: Sending %s to %s...", l.Transport.Name, s))
+	if _, err := s.send(msgStartTransport, transportPayload(l)); err != nil {
+		log(fmt.Sprintf("ERROR: Could not send start_transport to %s: %v", s, err))
+	}
+}
+func (s *controlSession) String() string {
+	// String is called with s.mu held, so RemoteAddr has its own lock.
+	s.addrMu.Lock()
+	defer s.addrMu.Unlock()
+	return fmt.Sprintf("session %s (%s)", s.ID, s.RemoteAddr)
+}
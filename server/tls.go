@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	stdlog "log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const certPollInterval = 30 * time.Second
+
+type logWriter struct {
+	prefix string
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	log(w.prefix + strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+type certReloader struct {
+	mu         sync.RWMutex
+	cert       *tls.Certificate
+	modTime    time.Time
+	lastWarned time.Time
+	watchOnce  sync.Once
+}
+
+var serverCert certReloader
+
+func certFilesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{config.TlsCertPath, config.TlsKeyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+func (r *certReloader) load() error {
+	modTime, err := certFilesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(config.TlsCertPath, config.TlsKeyPath)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.lastWarned = time.Time{}
+	r.mu.Unlock()
+	log(fmt.Sprintf("INFO: Loaded TLS certificate %s (valid until %s).", config.TlsCertPath, leaf.NotAfter.Format("2006-01-02")))
+	r.checkExpiry()
+	return nil
+}
+func (r *certReloader) loaded() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert != nil
+}
+func (r *certReloader) reload() {
+	if !r.loaded() {
+		return
+	}
+	if err := r.load(); err != nil {
+		log(fmt.Sprintf("ERROR: Could not reload TLS certificate, keeping the current one: %v", err))
+	}
+}
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+func (r *certReloader) checkExpiry() {
+	warnDays := config.CertExpiryWarnDays
+	if warnDays == 0 {
+		warnDays = 14
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert == nil || time.Since(r.lastWarned) < 24*time.Hour {
+		return
+	}
+	remaining := time.Until(r.cert.Leaf.NotAfter)
+	if remaining > time.Duration(warnDays)*24*time.Hour {
+		return
+	}
+	r.lastWarned = time.Now()
+	if remaining <= 0 {
+		log(fmt.Sprintf("ERROR: TLS certificate %s expired on %s.", config.TlsCertPath, r.cert.Leaf.NotAfter.Format("2006-01-02")))
+		return
+	}
+	log(fmt.Sprintf("WARN: TLS certificate %s expires in %d days (%s).", config.TlsCertPath, int(remaining.Hours()/24), r.cert.Leaf.NotAfter.Format("2006-01-02")))
+}
+func (r *certReloader) watch() {
+	for range time.Tick(certPollInterval) {
+		modTime, err := certFilesModTime()
+		r.mu.RLock()
+		changed := err == nil && !modTime.Equal(r.modTime)
+		r.mu.RUnlock()
+		if changed {
+			log("INFO: TLS certificate files changed on disk, reloading.")
+			r.reload()
+		}
+		r.checkExpiry()
+	}
+}
+func certificateTLSConfig() (*tls.Config, error) {
+	if acmeEnabled() {
+		return acmeTLSConfig()
+	}
+	if !serverCert.loaded() {
+		if err := serverCert.load(); err != nil {
+			return nil, err
+		}
+	}
+	serverCert.watchOnce.Do(func() {
+		go serverCert.watch()
+	})
+	return &tls.Config{GetCertificate: serverCert.GetCertificate}, nil
+}
+func serverTLSConfig() (*tls.Config, error) {
+	tlsConfig, err := certificateTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.ClientCAPath != "" {
+		pem, err := os.ReadFile(config.ClientCAPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.ClientCAPath)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+func httpErrorLog() *stdlog.Logger {
+	return stdlog.New(logWriter{prefix: "WARN: "}, "", 0)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const maxUdpStreamTargets = 256
+const defaultUdpIdleTimeout = 60
+
+func udpIdleTimeout() time.Duration {
+	timeout := config.UdpIdleTimeout
+	if timeout <= 0 {
+		timeout = defaultUdpIdleTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+func udpStreamTarget(header StreamHeader) (string, error) {
+	if header.Target != "" {
+		if header.Mapping != "" {
+			return "", fmt.Errorf("stream names both mapping '%s' and target '%s'", header.Mapping, header.Target)
+		}
+		return checkTarget(header.Target)
+	}
+	return mappingTarget(header.Mapping)
+}
+func serveUdpStream(stream io.ReadWriteCloser, header StreamHeader, remote string) {
+	defer stream.Close()
+	if findSession(header.Token) == nil {
+		stream.Write([]byte{dialDenied})
+		log(fmt.Sprintf("WARN: Rejected UDP stream from %s: udp streams need the token of a control session", remote))
+		return
+	}
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		stream.Write([]byte{dialFailed})
+		log(fmt.Sprintf("WARN: Could not open UDP relay for %s: %v", remote, err))
+		return
+	}
+	defer udpConn.Close()
+	if _, err := stream.Write([]byte{dialOk}); err != nil {
+		return
+	}
+	timeout := udpIdleTimeout()
+	idle := time.AfterFunc(timeout, func() {
+		stream.Close()
+		udpConn.Close()
+	})
+	defer idle.Stop()
+	// Replies are only relayed from addresses the client has sent to, so the
+	// relay socket cannot be used to receive traffic from arbitrary hosts.
+	var mu sync.Mutex
+	targets := make(map[string]*net.UDPAddr)
+	sources := make(map[string]bool)
+	go func() {
+		defer stream.Close()
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			known := sources[from.String()]
+			mu.Unlock()
+			if !known {
+				continue
+			}
+			idle.Reset(timeout)
+			if err := writeDatagram(stream, from.String(), buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		target, payload, err := readDatagram(stream)
+		if err != nil {
+			return
+		}
+		idle.Reset(timeout)
+		mu.Lock()
+		addr, ok := targets[target]
+		mu.Unlock()
+		if !ok {
+			var checked string
+			if target == "" {
+				checked, err = udpStreamTarget(header)
+			} else {
+				checked, err = checkTarget(target)
+			}
+			if err == nil {
+				addr, err = net.ResolveUDPAddr("udp", checked)
+			}
+			if err != nil {
+				log(fmt.Sprintf("WARN: Dropped UDP datagram from %s to %s: %v", remote, target, err))
+				continue
+			}
+			mu.Lock()
+			if len(targets) >= maxUdpStreamTargets {
+				targets = make(map[string]*net.UDPAddr)
+				sources = make(map[string]bool)
+			}
+			targets[target] = addr
+			sources[addr.String()] = true
+			mu.Unlock()
+		}
+		udpConn.WriteToUDP(payload, addr)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestUdpStreamRelaysOnlyFromTargets(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	relayAddr := make(chan *net.UDPAddr, 1)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case relayAddr <- from:
+			default:
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+	stranger, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	defer func(saved *allowlist) { targetAllowlist = saved }(targetAllowlist)
+	if targetAllowlist, err = compileAllowlist(TargetAllowlist{CIDRs: []string{"127.0.0.0/8"}}); err != nil {
+		t.Fatal(err)
+	}
+	sessionsMu.Lock()
+	sessions["udp-test"] = &controlSession{ID: "udp-test", Token: "udp-token"}
+	sessionsMu.Unlock()
+	defer func() {
+		sessionsMu.Lock()
+		delete(sessions, "udp-test")
+		sessionsMu.Unlock()
+	}()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go serveUdpStream(serverConn, StreamHeader{Type: streamUdp, Token: "udp-token"}, "test")
+	status := make([]byte, 1)
+	if _, err := clientConn.Read(status); err != nil || status[0] != dialOk {
+		t.Fatalf("dial status = %v, %v, want ok", status, err)
+	}
+	roundTrip := func(payload string) {
+		t.Helper()
+		if err := writeDatagram(clientConn, echo.LocalAddr().String(), []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+		from, reply, err := readDatagram(clientConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from != echo.LocalAddr().String() || string(reply) != payload {
+			t.Fatalf("relayed %q from %s, want %q from %s", reply, from, payload, echo.LocalAddr())
+		}
+	}
+	roundTrip("first")
+	if _, err := stranger.WriteToUDP([]byte("spoofed"), <-relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip("second")
+}